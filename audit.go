@@ -0,0 +1,64 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// auditMu serializes appends to audit logs, which several wrappers in one
+// process may share.
+var auditMu sync.Mutex
+
+// audit appends a record of operation and its outcome to the audit log set
+// by WithAuditLog. Failing to write the record does not fail the operation.
+func (sw *ServiceWrapper) audit(operation string, opErr error) {
+	if sw.auditLogPath == "" {
+		return
+	}
+	exepath, err := sw.ExePath()
+	if err != nil {
+		exepath = "?"
+	}
+	outcome := "ok"
+	if opErr != nil {
+		outcome = fmt.Sprintf("failed: %s", opErr)
+	}
+	line := fmt.Sprintf("%s %s service=%q exe=%q user=%q %s\n",
+		time.Now().Format(time.RFC3339), operation, sw.serviceName, exepath, currentUsername(), outcome)
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	f, err := os.OpenFile(sw.auditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "when opening the audit log: %s\n", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.WriteString(line); err != nil {
+		fmt.Fprintf(os.Stderr, "when writing the audit log: %s\n", err)
+	}
+}
+
+// currentUsername returns the DOMAIN\user of the process token.
+func currentUsername() string {
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return "?"
+	}
+	account, domain, _, err := user.User.Sid.LookupAccount("")
+	if err != nil {
+		return user.User.Sid.String()
+	}
+	return domain + `\` + account
+}
@@ -0,0 +1,52 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+// COMModel is the COM apartment model WithCOMInit initializes the service
+// thread with.
+type COMModel int
+
+const (
+	COMNone              COMModel = iota // COM is not initialized
+	COMMultiThreaded                     // the multithreaded apartment (MTA)
+	COMApartmentThreaded                 // a single-threaded apartment (STA)
+)
+
+func (m COMModel) String() string {
+	switch m {
+	case COMNone:
+		return "none"
+	case COMMultiThreaded:
+		return "MTA"
+	case COMApartmentThreaded:
+		return "STA"
+	}
+	return fmt.Sprintf("COMModel(%d)", int(m))
+}
+
+// initCOM initializes COM on the calling thread, which must be locked. When
+// COM was already initialized with the same model, the call still counts
+// and the returned function balances it; a different model is an error.
+func initCOM(model COMModel) (func(), error) {
+	coInit := uint32(windows.COINIT_MULTITHREADED)
+	if model == COMApartmentThreaded {
+		coInit = windows.COINIT_APARTMENTTHREADED
+	}
+	err := windows.CoInitializeEx(0, coInit)
+	if err != nil && !errors.Is(err, windows.Errno(windows.S_FALSE)) {
+		return nil, fmt.Errorf("CoInitializeEx(%s) failed: %w", model, err)
+	}
+	return windows.CoUninitialize, nil
+}
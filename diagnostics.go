@@ -0,0 +1,132 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// Diagnostics writes a report of everything relevant to support requests to
+// w: the environment, the installed config and state, the recovery
+// settings, the trigger count and the event source registration. A section
+// that cannot be read is reported as an error and the report goes on. The
+// SCM never returns the account password, so the report cannot contain it.
+func (sw *ServiceWrapper) Diagnostics(w io.Writer) error {
+	p := func(format string, args ...any) {
+		fmt.Fprintf(w, format+"\n", args...)
+	}
+	version := windows.RtlGetVersion()
+	p("generated:          %s", time.Now().Format(time.RFC3339))
+	p("os version:         %d.%d.%d", version.MajorVersion, version.MinorVersion, version.BuildNumber)
+	p("go version:         %s %s/%s", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	p("elevated:           %t", isElevated())
+	if sw.remoteHost != "" {
+		p("remote host:        %s", sw.remoteHost)
+	}
+	p("service name:       %s", sw.serviceName)
+	if exepath, err := sw.ExePath(); err != nil {
+		p("exe path:           error: %s", err)
+	} else {
+		p("exe path:           %s", exepath)
+	}
+	info, err := sw.ServiceInfo()
+	if err != nil {
+		p("installed:          error: %s", err)
+		return nil
+	}
+	p("installed:          true")
+	p("display name:       %s", info.DisplayName)
+	p("description:        %s", info.Description)
+	p("command line:       %s", info.BinaryPathName)
+	p("service type:       %#x", info.ServiceType)
+	p("start type:         %s", startTypeString(info.StartType))
+	p("account:            %s", info.Account)
+	p("dependencies:       %s", strings.Join(info.Dependencies, ", "))
+	p("state:              %s", StateString(info.State))
+	p("accepted controls:  %#x", uint32(info.Accepts))
+	if info.ProcessID != 0 {
+		p("pid:                %d", info.ProcessID)
+	}
+	if !info.StartTime.IsZero() {
+		p("process started:    %s", info.StartTime.Format(time.RFC3339))
+	}
+	if info.State == svc.Stopped {
+		p("exit code:          %d", info.ExitCode)
+	}
+	if recovery, err := sw.RecoveryConfig(); err != nil {
+		p("recovery:           error: %s", err)
+	} else {
+		for i, action := range recovery.Actions {
+			p("recovery action %d:  type %d after %s", i+1, action.Type, action.Delay)
+		}
+		p("recovery reset:     %s", recovery.ResetPeriod)
+		p("recovery command:   %s", recovery.Command)
+		p("recovery non-crash: %t", recovery.OnNonCrash)
+	}
+	if timeout, err := sw.PreshutdownTimeout(); err != nil {
+		p("preshutdown:        error: %s", err)
+	} else {
+		p("preshutdown:        %s", timeout)
+	}
+	if count, err := sw.triggerCount(); err != nil {
+		p("triggers:           error: %s", err)
+	} else {
+		p("triggers:           %d", count)
+	}
+	if sw.remoteHost == "" {
+		if registered, err := sw.EventSourceRegistered(); err != nil {
+			p("event source:       error: %s", err)
+		} else {
+			p("event source:       %t", registered)
+		}
+	}
+	return nil
+}
+
+// triggerCount returns the number of start and stop triggers of the
+// installed service.
+func (sw *ServiceWrapper) triggerCount() (uint32, error) {
+	var count uint32
+	err := sw.queryService(func(s *mgr.Service) error {
+		b, err := queryServiceConfig2(s, windows.SERVICE_CONFIG_TRIGGER_INFO)
+		if err != nil {
+			return fmt.Errorf("could not retrieve triggers: %v", err)
+		}
+		// SERVICE_TRIGGER_INFO starts with the trigger count.
+		count = *(*uint32)(unsafe.Pointer(&b[0]))
+		return nil
+	})
+	return count, err
+}
+
+// writeDiagnostics writes the Diagnostics report to the file at path, or to
+// stdout if path is empty.
+func (sw *ServiceWrapper) writeDiagnostics(path string) error {
+	if path == "" {
+		return sw.Diagnostics(os.Stdout)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := sw.Diagnostics(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
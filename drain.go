@@ -0,0 +1,91 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// ControlDrain is the custom control code asking a running service to stop
+// accepting new work while finishing what it has in flight. The service
+// keeps running once drained; DrainService sends the control.
+const ControlDrain = svc.Cmd(129)
+
+// drainProgressInterval is how often the checkpoint of a draining service
+// is advanced.
+const drainProgressInterval = time.Second
+
+// Drainer can optionally be implemented by a Service to support
+// ControlDrain. Drain returns once the in-flight work is done; ctx is
+// cancelled when the service is stopped before that.
+type Drainer interface {
+	Drain(ctx context.Context) error
+}
+
+// drain runs the Drainer of the service in the background, so the service
+// can still be stopped while draining. Until it returns, the Running status
+// is reported with an increasing checkpoint for operators to watch.
+func (sw *ServiceWrapper) drain(ctx context.Context, wg *sync.WaitGroup, status *statusReporter, draining *atomic.Bool) {
+	drainer, ok := sw.service.(Drainer)
+	if !ok {
+		elog.Warning(1, fmt.Sprintf("The service '%s' does not support draining", sw.serviceName))
+		return
+	}
+	if !draining.CompareAndSwap(false, true) {
+		elog.Info(1, fmt.Sprintf("The service '%s' is already draining", sw.serviceName))
+		return
+	}
+	elog.Info(1, fmt.Sprintf("The service '%s' is draining", sw.serviceName))
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer draining.Store(false)
+		done := make(chan error, 1)
+		go func() { done <- drainer.Drain(ctx) }()
+		ticker := time.NewTicker(drainProgressInterval)
+		defer ticker.Stop()
+		running := status.status()
+		for {
+			select {
+			case err := <-done:
+				running.CheckPoint = 0
+				status.reportIfRunning(running)
+				if err != nil {
+					elog.Error(1, fmt.Sprintf("When draining the service '%s': %s", sw.serviceName, err))
+					return
+				}
+				elog.Info(1, fmt.Sprintf("The service '%s' is drained", sw.serviceName))
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				running.CheckPoint++
+				status.reportIfRunning(running)
+			}
+		}
+	}()
+}
+
+// DrainService sends ControlDrain to the running service. It returns
+// without waiting for the drain to complete; the checkpoint reported by
+// QueryStatus advances until it has.
+func (sw *ServiceWrapper) DrainService() error {
+	return sw.withService(func(s *mgr.Service) error {
+		if _, err := s.Control(ControlDrain); err != nil {
+			return fmt.Errorf("could not send control=%d: %v", ControlDrain, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,154 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// ConfigDrift compares the installed service with the desired config of the
+// wrapper and returns a description of each difference, e.g.
+// `start type is manual, want automatic`. An empty result means Reconfigure
+// has nothing to change; EnsureInstalled only reconfigures on drift.
+// The recovery settings, the preshutdown timeout and the required privileges
+// are only compared when the wrapper sets them.
+func (sw *ServiceWrapper) ConfigDrift() ([]string, error) {
+	exepath, err := sw.ExePath()
+	if err != nil {
+		return nil, err
+	}
+	want, err := sw.validatedConfig(exepath)
+	if err != nil {
+		return nil, err
+	}
+	var drift []string
+	differs := func(field string, got, want any) {
+		drift = append(drift, fmt.Sprintf("%s is %v, want %v", field, got, want))
+	}
+	err = sw.queryService(func(s *mgr.Service) error {
+		got, err := s.Config()
+		if err != nil {
+			return fmt.Errorf("could not retrieve service config: %v", err)
+		}
+		if got.DisplayName != want.DisplayName {
+			differs("display name", fmt.Sprintf("%q", got.DisplayName), fmt.Sprintf("%q", want.DisplayName))
+		}
+		if got.Description != want.Description {
+			differs("description", fmt.Sprintf("%q", got.Description), fmt.Sprintf("%q", want.Description))
+		}
+		if got.BinaryPathName != want.BinaryPathName {
+			differs("command line", got.BinaryPathName, want.BinaryPathName)
+		}
+		if got.ServiceType != want.ServiceType {
+			differs("service type", fmt.Sprintf("%#x", got.ServiceType), fmt.Sprintf("%#x", want.ServiceType))
+		}
+		if got.StartType != want.StartType {
+			differs("start type", startTypeString(got.StartType), startTypeString(want.StartType))
+		}
+		if got.SidType != want.SidType {
+			differs("service SID type", got.SidType, want.SidType)
+		}
+		if !sameAccount(got.ServiceStartName, want.ServiceStartName) {
+			differs("account", got.ServiceStartName, accountName(want.ServiceStartName))
+		}
+		if strings.Join(got.Dependencies, ",") != strings.Join(want.Dependencies, ",") {
+			differs("dependencies", got.Dependencies, want.Dependencies)
+		}
+		if len(sw.recovery.Actions) > 0 || sw.recoveryNonCrashSet {
+			got, err := readRecovery(s)
+			if err != nil {
+				return err
+			}
+			drift = append(drift, sw.recoveryDrift(got)...)
+		}
+		if sw.preshutdownTimeout > 0 {
+			got, err := queryPreshutdownTimeout(s)
+			if err != nil {
+				return err
+			}
+			if got != sw.preshutdownTimeout {
+				differs("preshutdown timeout", got, sw.preshutdownTimeout)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(sw.requiredPrivileges) > 0 {
+		privileges, err := sw.RequiredPrivileges()
+		if err != nil {
+			return nil, err
+		}
+		if strings.Join(privileges, ",") != strings.Join(sw.requiredPrivileges, ",") {
+			differs("required privileges", privileges, sw.requiredPrivileges)
+		}
+	}
+	return drift, nil
+}
+
+// recoveryDrift compares the installed recovery settings got with those of
+// the wrapper, the way applyRecovery sets them: the command and the reboot
+// message only with recovery actions, and only when they are not empty.
+func (sw *ServiceWrapper) recoveryDrift(got RecoverySettings) []string {
+	var drift []string
+	differs := func(field string, got, want any) {
+		drift = append(drift, fmt.Sprintf("%s is %v, want %v", field, got, want))
+	}
+	want := sw.recovery
+	if sw.recoveryNonCrashSet && got.OnNonCrash != want.OnNonCrash {
+		differs("recovery on non-crash failures", got.OnNonCrash, want.OnNonCrash)
+	}
+	if len(want.Actions) == 0 {
+		return drift
+	}
+	if !sameRecoveryActions(got.Actions, want.Actions) {
+		differs("recovery actions", got.Actions, want.Actions)
+	}
+	if resetPeriod := want.ResetPeriod.Truncate(time.Second); got.ResetPeriod != resetPeriod {
+		differs("recovery reset period", got.ResetPeriod, resetPeriod)
+	}
+	if want.Command != "" && got.Command != want.Command {
+		differs("recovery command", fmt.Sprintf("%q", got.Command), fmt.Sprintf("%q", want.Command))
+	}
+	if want.RebootMessage != "" && got.RebootMessage != want.RebootMessage {
+		differs("reboot message", fmt.Sprintf("%q", got.RebootMessage), fmt.Sprintf("%q", want.RebootMessage))
+	}
+	return drift
+}
+
+func sameAccount(a, b string) bool {
+	if isLocalSystemAccount(a) || isLocalSystemAccount(b) {
+		return isLocalSystemAccount(a) && isLocalSystemAccount(b)
+	}
+	return strings.EqualFold(a, b)
+}
+
+// accountName returns the name the SCM reports for account.
+func accountName(account string) string {
+	if isLocalSystemAccount(account) {
+		return "LocalSystem"
+	}
+	return account
+}
+
+func sameRecoveryActions(a, b []mgr.RecoveryAction) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Type != b[i].Type || a[i].Delay.Truncate(time.Millisecond) != b[i].Delay.Truncate(time.Millisecond) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,32 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import "errors"
+
+var (
+	// ErrNotInstalled is returned by queries on a service that is not installed.
+	ErrNotInstalled = errors.New("service is not installed")
+	// ErrMarkedForDeletion is returned by InstallService while a previously
+	// removed service still has open handles. Wait for the removal to
+	// complete with WaitRemoved and retry.
+	ErrMarkedForDeletion = errors.New("service is marked for deletion")
+	// ErrNotRunning is returned for run state requested outside a run.
+	ErrNotRunning = errors.New("service is not running")
+	// ErrAlreadyRunning is returned by RunService and RunForeground when
+	// the wrapper is already running the service, or another instance
+	// holds the mutex set by WithSingleInstanceMutex.
+	ErrAlreadyRunning = errors.New("another instance of the service is running")
+	// ErrOperationPending is returned when the service cannot accept a
+	// control because another start, stop, pause or continue is pending.
+	ErrOperationPending = errors.New("another operation is pending on the service")
+	// ErrUsage is returned by ManageService for a command line it cannot
+	// run, once it has printed the usage text. Hosts conventionally exit
+	// with code 2 for it.
+	ErrUsage = errors.New("invalid command line")
+)
@@ -0,0 +1,95 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc/debug"
+)
+
+// ETW trace levels, see TRACE_LEVEL_* in evntrace.h.
+const (
+	etwLevelError       = 2
+	etwLevelWarning     = 3
+	etwLevelInformation = 4
+)
+
+var (
+	procEventRegister    = modadvapi32.NewProc("EventRegister")
+	procEventUnregister  = modadvapi32.NewProc("EventUnregister")
+	procEventWriteString = modadvapi32.NewProc("EventWriteString")
+)
+
+func etwLevel(eventType uint16) uint8 {
+	switch eventType {
+	case windows.EVENTLOG_ERROR_TYPE:
+		return etwLevelError
+	case windows.EVENTLOG_WARNING_TYPE:
+		return etwLevelWarning
+	}
+	return etwLevelInformation
+}
+
+// uint64Args splits v into the words a 64-bit argument takes on the stack.
+func uint64Args(v uint64) []uintptr {
+	if unsafe.Sizeof(uintptr(0)) == 8 {
+		return []uintptr{uintptr(v)}
+	}
+	return []uintptr{uintptr(v), uintptr(v >> 32)}
+}
+
+// etwLog writes every message to an ETW provider and passes it on to the
+// wrapped log.
+type etwLog struct {
+	debug.Log
+	handle uint64
+}
+
+func openETWLog(provider windows.GUID, next debug.Log) (debug.Log, error) {
+	var handle uint64
+	r, _, _ := procEventRegister.Call(uintptr(unsafe.Pointer(&provider)), 0, 0, uintptr(unsafe.Pointer(&handle)))
+	if r != 0 {
+		return nil, fmt.Errorf("EventRegister() failed: %w", windows.Errno(r))
+	}
+	return &etwLog{Log: next, handle: handle}, nil
+}
+
+func (l *etwLog) write(level uint8, msg string) {
+	text, err := windows.UTF16PtrFromString(msg)
+	if err != nil {
+		return
+	}
+	args := uint64Args(l.handle)
+	args = append(args, uintptr(level))
+	args = append(args, uint64Args(0)...) // keyword
+	args = append(args, uintptr(unsafe.Pointer(text)))
+	procEventWriteString.Call(args...)
+}
+
+func (l *etwLog) Info(eid uint32, msg string) error {
+	l.write(etwLevelInformation, msg)
+	return l.Log.Info(eid, msg)
+}
+
+func (l *etwLog) Warning(eid uint32, msg string) error {
+	l.write(etwLevelWarning, msg)
+	return l.Log.Warning(eid, msg)
+}
+
+func (l *etwLog) Error(eid uint32, msg string) error {
+	l.write(etwLevelError, msg)
+	return l.Log.Error(eid, msg)
+}
+
+func (l *etwLog) Close() error {
+	procEventUnregister.Call(uint64Args(l.handle)...)
+	return l.Log.Close()
+}
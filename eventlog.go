@@ -0,0 +1,213 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc/debug"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+const defaultEventLogTimeout = 5 * time.Second
+
+// EventIDUnexpectedControl is the event ID of the warning logged when the
+// service receives a control request it does not handle. Other messages of
+// the wrapper use event ID 1.
+const EventIDUnexpectedControl uint32 = 2
+
+// EventCategoryLifecycle is the event category of the records marking that
+// the service is running or has failed. Other records have category 0.
+const EventCategoryLifecycle uint16 = 1
+
+// Event is an event log record with the category and raw data fields that
+// Info, Warning and Error leave empty.
+type Event struct {
+	Type     uint16 // windows.EVENTLOG_INFORMATION_TYPE, _WARNING_TYPE or _ERROR_TYPE
+	Category uint16
+	ID       uint32
+	Message  string
+	Data     []byte // binary data shown with the record
+}
+
+// LogEvent writes e to the log of the running service. The category and
+// data only reach the event log; the console log of a debug run and ETW get
+// the message alone.
+func LogEvent(e Event) error {
+	return logEvent(elog, e)
+}
+
+func logEvent(l debug.Log, e Event) error {
+	switch l := l.(type) {
+	case *eventlog.Log:
+		msg, err := windows.UTF16PtrFromString(e.Message)
+		if err != nil {
+			return err
+		}
+		var data *byte
+		if len(e.Data) > 0 {
+			data = &e.Data[0]
+		}
+		return windows.ReportEvent(l.Handle, e.Type, e.Category, e.ID, 0, 1, uint32(len(e.Data)), &msg, data)
+	case *etwLog:
+		l.write(etwLevel(e.Type), e.Message)
+		return logEvent(l.Log, e)
+	}
+	switch e.Type {
+	case windows.EVENTLOG_ERROR_TYPE:
+		return l.Error(e.ID, e.Message)
+	case windows.EVENTLOG_WARNING_TYPE:
+		return l.Warning(e.ID, e.Message)
+	}
+	return l.Info(e.ID, e.Message)
+}
+
+// exitCodeData is the raw data of a failure record, the exit code as a
+// little-endian DWORD.
+func exitCodeData(errno uint32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, errno)
+}
+
+// nopLog is used in place of the event log when it cannot be opened in time.
+type nopLog struct{}
+
+func (nopLog) Close() error                         { return nil }
+func (nopLog) Info(eid uint32, msg string) error    { return nil }
+func (nopLog) Warning(eid uint32, msg string) error { return nil }
+func (nopLog) Error(eid uint32, msg string) error   { return nil }
+
+type openLogResult struct {
+	log *eventlog.Log
+	err error
+}
+
+// openEventLog opens the event log for the service, falling back to a no-op
+// logger if the Event Log service does not answer within the timeout.
+func (sw *ServiceWrapper) openEventLog() (debug.Log, error) {
+	result := make(chan openLogResult, 1)
+	go func() {
+		l, err := eventlog.Open(sw.serviceName)
+		result <- openLogResult{log: l, err: err}
+	}()
+	timer := time.NewTimer(sw.eventLogTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-result:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return r.log, nil
+	case <-timer.C:
+		go func() {
+			if r := <-result; r.err == nil {
+				r.log.Close()
+			}
+		}()
+		fmt.Fprintf(os.Stderr, "opening the eventlog for %s did not complete within %s, continuing without event logging\n", sw.serviceName, sw.eventLogTimeout)
+		return nopLog{}, nil
+	}
+}
+
+// closeEventLog closes l, abandoning the close if it does not complete
+// within the timeout.
+func (sw *ServiceWrapper) closeEventLog(l debug.Log) {
+	done := make(chan struct{})
+	go func() {
+		l.Close()
+		close(done)
+	}()
+	timer := time.NewTimer(sw.eventLogTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		fmt.Fprintf(os.Stderr, "closing the eventlog for %s did not complete within %s\n", sw.serviceName, sw.eventLogTimeout)
+	}
+}
+
+// usesEventSource reports whether install and remove manage the event
+// source. That is skipped on request, for remote hosts and for drivers.
+func (sw *ServiceWrapper) usesEventSource() bool {
+	return !sw.skipEventSource && sw.remoteHost == "" && !sw.isDriver()
+}
+
+// RegisterEventSource registers the service name as an event log source.
+// InstallService does this unless WithoutEventSourceRegistration is given.
+//
+// The source is registered under
+// HKLM\SYSTEM\CurrentControlSet\Services\EventLog\Application\<service name>
+// with the values EventMessageFile, naming the DLL that formats the
+// messages, and TypesSupported. EventMessageFile is the EventCreate.exe of
+// the system unless WithEventMessageFile names another file.
+func (sw *ServiceWrapper) RegisterEventSource() error {
+	events := uint32(eventlog.Error | eventlog.Warning | eventlog.Info)
+	if sw.eventMessageFile != "" {
+		path, err := resolvePath(sw.eventMessageFile)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("when opening the event message file: %w", err)
+		}
+		f.Close()
+		if err := eventlog.Install(sw.serviceName, path, false, events); err != nil {
+			return fmt.Errorf("SetupEventLogSource() failed: %s", err)
+		}
+		return nil
+	}
+	err := eventlog.InstallAsEventCreate(sw.serviceName, events)
+	if err != nil {
+		return fmt.Errorf("SetupEventLogSource() failed: %s", err)
+	}
+	return nil
+}
+
+// UnregisterEventSource removes the event log source registered by
+// RegisterEventSource.
+func (sw *ServiceWrapper) UnregisterEventSource() error {
+	err := eventlog.Remove(sw.serviceName)
+	if err != nil {
+		return fmt.Errorf("RemoveEventLogSource() failed: %s", err)
+	}
+	return nil
+}
+
+// EventSourceRegistered reports whether the event source of the service is
+// registered on the local machine. A service whose install was interrupted
+// can exist without it, making the event log fail to open at start.
+func (sw *ServiceWrapper) EventSourceRegistered() (bool, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Services\EventLog\Application\`+sw.serviceName, registry.QUERY_VALUE)
+	if errors.Is(err, registry.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("when opening the event source key: %w", err)
+	}
+	k.Close()
+	return true, nil
+}
+
+// repairEventSource registers the event source if the service uses one and
+// it is missing.
+func (sw *ServiceWrapper) repairEventSource() error {
+	if !sw.usesEventSource() {
+		return nil
+	}
+	registered, err := sw.EventSourceRegistered()
+	if err != nil || registered {
+		return err
+	}
+	return sw.RegisterEventSource()
+}
@@ -0,0 +1,70 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/debug"
+)
+
+// RunForeground runs the service in the calling goroutine without the SCM,
+// logging to the console, e.g. in containers. Cancelling ctx stops the
+// service as a stop control would, and so do Ctrl+C and Ctrl+Break and the
+// console being closed, or the container being stopped. It returns once the
+// service has stopped, with an error if it exited with a non-zero code.
+func (sw *ServiceWrapper) RunForeground(ctx context.Context) error {
+	if !sw.running.CompareAndSwap(false, true) {
+		return fmt.Errorf("%s is already being run by this wrapper: %w", sw.serviceName, ErrAlreadyRunning)
+	}
+	defer sw.running.Store(false)
+	// Go delivers Ctrl+C and Ctrl+Break as os.Interrupt, and closing the
+	// console or shutting down as SIGTERM.
+	ctx, stopSignals := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	sw.setRunMode(RunModeForeground)
+	elog = debug.New(sw.serviceName)
+	r := make(chan svc.ChangeRequest)
+	changes := make(chan svc.Status)
+	done := make(chan struct{})
+	var ssec bool
+	var errno uint32
+	go func() {
+		defer close(done)
+		ssec, errno = sw.Execute([]string{sw.serviceName}, r, changes)
+	}()
+	stop := ctx.Done()
+	var current svc.Status
+	for {
+		select {
+		case <-done:
+			if errno == 0 {
+				return nil
+			}
+			if ssec {
+				return fmt.Errorf("service exited with service-specific code %d", errno)
+			}
+			return fmt.Errorf("service exited with code %d", errno)
+		case current = <-changes:
+		case <-stop:
+			stop = nil
+			request := svc.ChangeRequest{Cmd: svc.Stop, CurrentStatus: current}
+			go func() {
+				select {
+				case r <- request:
+				case <-done:
+				}
+			}()
+		}
+	}
+}
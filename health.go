@@ -0,0 +1,64 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const healthShutdownTimeout = 5 * time.Second
+
+// HealthChecker can optionally be implemented by a Service to report its
+// health to the health endpoint set by WithHealthEndpoint. A service not
+// implementing it is healthy as long as it runs.
+type HealthChecker interface {
+	Healthy() error
+}
+
+// startHealthEndpoint binds the health endpoint and serves it until ctx is
+// done. The serving goroutines are added to wg.
+func (sw *ServiceWrapper) startHealthEndpoint(ctx context.Context, wg *sync.WaitGroup) error {
+	listener, err := net.Listen("tcp", sw.healthAddr)
+	if err != nil {
+		return fmt.Errorf("when binding the health endpoint %s: %w", sw.healthAddr, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", sw.serveHealth)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: healthShutdownTimeout}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			elog.Error(1, fmt.Sprintf("The health endpoint of the service '%s' failed: %s", sw.serviceName, err))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), healthShutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	return nil
+}
+
+func (sw *ServiceWrapper) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if checker, ok := sw.service.(HealthChecker); ok {
+		if err := checker.Healthy(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -8,15 +8,29 @@
 package svchelper
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
-	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/svc/mgr"
 )
 
 func (sw *ServiceWrapper) ExePath() (string, error) {
+	if sw.driverPath != "" {
+		if _, err := os.Stat(sw.driverPath); err != nil {
+			return "", err
+		}
+		return sw.driverPath, nil
+	}
+	if sw.exePathResolver != nil {
+		return resolvedExePath(sw.exePathResolver)
+	}
 	prog := os.Args[0]
 	p, err := filepath.Abs(prog)
 	if err != nil {
@@ -42,52 +56,479 @@ func (sw *ServiceWrapper) ExePath() (string, error) {
 	return "", err
 }
 
+// resolvedExePath runs the resolver set by WithExePathResolver and checks
+// that it names an existing file.
+func resolvedExePath(resolver func() (string, error)) (string, error) {
+	p, err := resolver()
+	if err != nil {
+		return "", fmt.Errorf("when resolving the executable path: %w", err)
+	}
+	if p, err = filepath.Abs(p); err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	if fi.IsDir() {
+		return "", fmt.Errorf("%s is directory", p)
+	}
+	return p, nil
+}
+
+// serviceArgs returns the arguments the SCM passes to the installed binary,
+// carrying an overridden service name so the instance knows who it is.
+func (sw *ServiceWrapper) serviceArgs(args ...string) []string {
+	if sw.isDriver() {
+		return nil
+	}
+	if sw.serviceNameOverridden {
+		args = append([]string{serviceNameFlag, sw.serviceName}, args...)
+	}
+	return args
+}
+
+// connect opens the SCM of the remote host set by WithRemoteHost, or the
+// local SCM by default.
+func (sw *ServiceWrapper) connect() (*mgr.Mgr, error) {
+	if sw.remoteHost != "" {
+		return mgr.ConnectRemote(sw.remoteHost)
+	}
+	return mgr.Connect()
+}
+
+// connectReadOnly connects to the SCM with the rights needed to look up and
+// enumerate services only, which unlike the full access requested by
+// mgr.Connect does not require elevation.
+func (sw *ServiceWrapper) connectReadOnly() (*mgr.Mgr, error) {
+	var host *uint16
+	if sw.remoteHost != "" {
+		var err error
+		if host, err = windows.UTF16PtrFromString(sw.remoteHost); err != nil {
+			return nil, err
+		}
+	}
+	h, err := windows.OpenSCManager(host, nil, windows.SC_MANAGER_CONNECT|windows.SC_MANAGER_ENUMERATE_SERVICE)
+	if err != nil {
+		return nil, err
+	}
+	return &mgr.Mgr{Handle: h}, nil
+}
+
+func (sw *ServiceWrapper) serviceConfig() mgr.Config {
+	config := mgr.Config{
+		DisplayName:      sw.serviceDisplayName,
+		Description:      sw.serviceDescription,
+		ServiceType:      sw.serviceType,
+		SidType:          sw.effectiveSidType(),
+		StartType:        sw.startType,
+		Dependencies:     sw.dependencies,
+		ServiceStartName: sw.serviceAccount,
+		Password:         sw.servicePassword,
+	}
+	if sw.interactive {
+		config.ServiceType |= windows.SERVICE_INTERACTIVE_PROCESS
+	}
+	return config
+}
+
+// InstallResult describes what InstallServiceWithResult did.
+type InstallResult struct {
+	ServiceName        string
+	ExePath            string // resolved executable path
+	CommandLine        string // registered with the SCM
+	EventSourceCreated bool
+}
+
 func (sw *ServiceWrapper) InstallService() error {
+	_, err := sw.InstallServiceWithResult()
+	return err
+}
+
+// InstallServiceWithResult is InstallService reporting the details of the
+// install, e.g. for deployment logs.
+func (sw *ServiceWrapper) InstallServiceWithResult() (result InstallResult, err error) {
+	defer func() { sw.audit("install", err) }()
 	exepath, err := sw.ExePath()
 	if err != nil {
-		return err
+		return result, err
 	}
-	m, err := mgr.Connect()
+	result = InstallResult{ServiceName: sw.serviceName, ExePath: exepath}
+	m, err := sw.connect()
 	if err != nil {
-		return err
+		return result, err
 	}
 	defer m.Disconnect()
 	s, err := m.OpenService(sw.serviceName)
 	if err == nil {
+		marked := markedForDeletion(s)
 		s.Close()
-		return fmt.Errorf("service %s already exists", sw.serviceName)
+		if marked {
+			return result, fmt.Errorf("service %s: %w, wait for the removal to complete and retry", sw.serviceName, ErrMarkedForDeletion)
+		}
+		return result, fmt.Errorf("service %s already exists", sw.serviceName)
 	}
-	s, err = m.CreateService(sw.serviceName, exepath, mgr.Config{DisplayName: sw.serviceDisplayName, Description: sw.serviceDescription, StartType: mgr.StartAutomatic}, "is", "auto-started")
+	if sw.grantLogonRight {
+		if err := grantAccountRight(sw.remoteHost, sw.serviceAccount, serviceLogonRight); err != nil {
+			return result, fmt.Errorf("when granting %s: %w", serviceLogonRight, err)
+		}
+	}
+	if sw.interactive {
+		fmt.Fprintf(os.Stderr, "warning: %s is installed as an interactive service, which is deprecated and only works under LocalSystem\n", sw.serviceName)
+	}
+	config, err := sw.validatedConfig(exepath)
 	if err != nil {
-		return err
+		return result, err
 	}
-	defer s.Close()
-	err = eventlog.InstallAsEventCreate(sw.serviceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+	result.CommandLine = config.BinaryPathName
+	if sw.preInstall != nil {
+		if err := sw.preInstall(exepath, config); err != nil {
+			return result, fmt.Errorf("pre-install hook failed: %w", err)
+		}
+	}
+	clearPassword, err := sw.applyPassword(&config)
 	if err != nil {
+		return result, err
+	}
+	s, err = m.CreateService(sw.serviceName, exepath, config, sw.serviceArgs("is", "auto-started")...)
+	clearPassword()
+	if errors.Is(err, windows.ERROR_SERVICE_MARKED_FOR_DELETE) {
+		return result, fmt.Errorf("service %s: %w, wait for the removal to complete and retry", sw.serviceName, ErrMarkedForDeletion)
+	}
+	if err != nil {
+		return result, err
+	}
+	defer s.Close()
+	if err := sw.configureService(s); err != nil {
 		s.Delete()
-		return fmt.Errorf("SetupEventLogSource() failed: %s", err)
+		return result, err
+	}
+	registerEventSource := sw.usesEventSource()
+	if registerEventSource {
+		if err := sw.RegisterEventSource(); err != nil {
+			s.Delete()
+			return result, err
+		}
+		result.EventSourceCreated = true
+	}
+	if sw.postInstall != nil {
+		if err := sw.postInstall(exepath, config); err != nil {
+			if registerEventSource {
+				sw.UnregisterEventSource()
+			}
+			s.Delete()
+			result.EventSourceCreated = false
+			return result, fmt.Errorf("post-install hook failed, service removed again: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// binaryPathName returns the command line the SCM runs for exepath, quoted
+// the same way mgr.CreateService does.
+func (sw *ServiceWrapper) binaryPathName(exepath string) string {
+	commandLine := syscall.EscapeArg(exepath)
+	for _, arg := range sw.serviceArgs("is", "auto-started") {
+		commandLine += " " + syscall.EscapeArg(arg)
+	}
+	return commandLine
+}
+
+// validatedConfig assembles the desired config for exepath and runs the
+// validator set by WithConfigValidator on it.
+func (sw *ServiceWrapper) validatedConfig(exepath string) (mgr.Config, error) {
+	config := sw.serviceConfig()
+	config.BinaryPathName = sw.binaryPathName(exepath)
+	if sw.descriptionSource != nil {
+		description, err := sw.descriptionSource()
+		if err != nil {
+			return config, err
+		}
+		description = strings.TrimSpace(description)
+		if utf8.RuneCountInString(description) > maxDescriptionLength {
+			return config, fmt.Errorf("description exceeds %d characters", maxDescriptionLength)
+		}
+		config.Description = description
+	}
+	if sw.configValidator != nil {
+		if err := sw.configValidator(config); err != nil {
+			return config, fmt.Errorf("service config rejected: %w", err)
+		}
+	}
+	return config, nil
+}
+
+// Reconfigure updates the installed service to the config and settings of
+// the wrapper, including the current executable path.
+func (sw *ServiceWrapper) Reconfigure() (err error) {
+	defer func() { sw.audit("reconfigure", err) }()
+	exepath, err := sw.ExePath()
+	if err != nil {
+		return err
+	}
+	config, err := sw.validatedConfig(exepath)
+	if err != nil {
+		return err
+	}
+	clearPassword, err := sw.applyPassword(&config)
+	if err != nil {
+		return err
+	}
+	defer clearPassword()
+	return sw.withService(func(s *mgr.Service) error {
+		if err := s.UpdateConfig(config); err != nil {
+			return fmt.Errorf("could not update service config: %v", err)
+		}
+		clearPassword()
+		return sw.configureService(s)
+	})
+}
+
+// InstallDisabled installs the service with start type mgr.StartDisabled,
+// so a deployment can validate it before EnableService and StartService
+// let it run.
+func (sw *ServiceWrapper) InstallDisabled() error {
+	startType := sw.startType
+	sw.startType = mgr.StartDisabled
+	defer func() { sw.startType = startType }()
+	return sw.InstallService()
+}
+
+// EnableService sets the installed service to the start type of the wrapper,
+// mgr.StartAutomatic unless WithStartType says otherwise, leaving the rest
+// of its config alone.
+func (sw *ServiceWrapper) EnableService() (err error) {
+	defer func() { sw.audit("enable", err) }()
+	startType := sw.startType
+	if startType == mgr.StartDisabled {
+		return fmt.Errorf("the start type of %s is disabled", sw.serviceName)
+	}
+	return sw.withService(func(s *mgr.Service) error {
+		config, err := s.Config()
+		if err != nil {
+			return fmt.Errorf("could not retrieve service config: %v", err)
+		}
+		config.StartType = startType
+		if err := s.UpdateConfig(config); err != nil {
+			return fmt.Errorf("could not update service config: %v", err)
+		}
+		return nil
+	})
+}
+
+// EnsureInstalled installs the service if it is missing. Otherwise it
+// reconfigures the service if its config drifted, see ConfigDrift, and
+// registers its event source again if that is missing, repairing
+// half-finished installs.
+func (sw *ServiceWrapper) EnsureInstalled() error {
+	installed, err := sw.IsInstalled()
+	if err != nil {
+		return err
+	}
+	if !installed {
+		return sw.InstallService()
+	}
+	drift, err := sw.ConfigDrift()
+	if err != nil {
+		return err
+	}
+	if len(drift) > 0 {
+		fmt.Fprintf(os.Stderr, "%s drifted from its config: %s\n", sw.serviceName, strings.Join(drift, "; "))
+		if err := sw.Reconfigure(); err != nil {
+			return err
+		}
+	}
+	return sw.repairEventSource()
+}
+
+// UpdateBinaryPath repoints the installed service to newPath, e.g. after an
+// upgrade moved the binary, keeping its arguments and all other settings.
+func (sw *ServiceWrapper) UpdateBinaryPath(newPath string) (err error) {
+	defer func() { sw.audit("update-binary-path", err) }()
+	newPath, err = filepath.Abs(newPath)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(newPath)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%s is directory", newPath)
+	}
+	return sw.withService(func(s *mgr.Service) error {
+		config, err := s.Config()
+		if err != nil {
+			return fmt.Errorf("could not retrieve service config: %v", err)
+		}
+		commandLine, err := windows.DecomposeCommandLine(config.BinaryPathName)
+		if err != nil || len(commandLine) == 0 {
+			return fmt.Errorf("could not parse the command line %q: %v", config.BinaryPathName, err)
+		}
+		config.BinaryPathName = syscall.EscapeArg(newPath)
+		for _, arg := range commandLine[1:] {
+			config.BinaryPathName += " " + syscall.EscapeArg(arg)
+		}
+		if err := s.UpdateConfig(config); err != nil {
+			return fmt.Errorf("could not update service config: %v", err)
+		}
+		return nil
+	})
+}
+
+// configureService applies the settings that CreateService does not cover.
+func (sw *ServiceWrapper) configureService(s *mgr.Service) error {
+	if sw.startType == windows.SERVICE_BOOT_START {
+		if err := setBootStart(s); err != nil {
+			return err
+		}
+	}
+	if len(sw.registryValues) > 0 {
+		if err := sw.writeRegistryValues(sw.registryValues); err != nil {
+			return err
+		}
+	}
+	if sw.preshutdownTimeout > 0 {
+		if err := setPreshutdownTimeout(s, sw.preshutdownTimeout); err != nil {
+			return err
+		}
+	}
+	if len(sw.installStartArgs) > 0 {
+		if err := sw.writeStartArgs(sw.installStartArgs); err != nil {
+			return err
+		}
+	}
+	if len(sw.requiredPrivileges) > 0 {
+		if err := setRequiredPrivileges(s, sw.requiredPrivileges); err != nil {
+			return err
+		}
+	}
+	if sw.serviceSDDL != "" {
+		if err := setServiceSDDL(s, sw.serviceSDDL); err != nil {
+			return err
+		}
+	}
+	return sw.applyRecovery(s)
+}
+
+// setBootStart sets the start type of s to windows.SERVICE_BOOT_START.
+// mgr.CreateService takes a zero start type for unset and installs
+// mgr.StartManual instead, so the boot start type is applied afterwards.
+func setBootStart(s *mgr.Service) error {
+	err := windows.ChangeServiceConfig(s.Handle, windows.SERVICE_NO_CHANGE, windows.SERVICE_BOOT_START,
+		windows.SERVICE_NO_CHANGE, nil, nil, nil, nil, nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("could not set the boot start type: %v", err)
 	}
 	return nil
 }
 
+// RemoveResult describes what RemoveServiceWithResult did.
+type RemoveResult struct {
+	ServiceName        string
+	ExePath            string // the service was installed with
+	EventSourceRemoved bool
+}
+
 func (sw *ServiceWrapper) RemoveService() error {
-	m, err := mgr.Connect()
+	_, err := sw.RemoveServiceWithResult()
+	return err
+}
+
+// RemoveServiceWithResult is RemoveService reporting the details of the
+// removal.
+func (sw *ServiceWrapper) RemoveServiceWithResult() (result RemoveResult, err error) {
+	defer func() { sw.audit("remove", err) }()
+	m, err := sw.connect()
 	if err != nil {
-		return err
+		return result, err
 	}
 	defer m.Disconnect()
 	s, err := m.OpenService(sw.serviceName)
 	if err != nil {
-		return fmt.Errorf("service %s is not installed", sw.serviceName)
+		return result, fmt.Errorf("service %s is not installed", sw.serviceName)
 	}
 	defer s.Close()
+	exepath := installedProgram(s)
+	result = RemoveResult{ServiceName: sw.serviceName, ExePath: exepath}
+	if sw.preRemove != nil {
+		if err := sw.preRemove(sw.serviceName, exepath); err != nil {
+			return result, fmt.Errorf("pre-remove hook failed: %w", err)
+		}
+	}
 	err = s.Delete()
 	if err != nil {
-		return err
+		return result, err
 	}
-	err = eventlog.Remove(sw.serviceName)
+	if sw.usesEventSource() {
+		if err := sw.UnregisterEventSource(); err != nil {
+			return result, err
+		}
+		result.EventSourceRemoved = true
+	}
+	if sw.postRemove != nil {
+		// The service is gone already, so a failing hook is only reported.
+		if err := sw.postRemove(sw.serviceName, exepath); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: post-remove hook for %s failed: %s\n", sw.serviceName, err)
+		}
+	}
+	return result, nil
+}
+
+// installedProgram returns the program registered for s, or an empty string
+// if it cannot be determined.
+func installedProgram(s *mgr.Service) string {
+	config, err := s.Config()
 	if err != nil {
-		return fmt.Errorf("RemoveEventLogSource() failed: %s", err)
+		return ""
+	}
+	commandLine, err := windows.DecomposeCommandLine(config.BinaryPathName)
+	if err != nil || len(commandLine) == 0 {
+		return ""
+	}
+	return commandLine[0]
+}
+
+// markedForDeletion reports whether s has been deleted but is kept alive by
+// open handles. A no-op config change is the cheapest call that tells.
+func markedForDeletion(s *mgr.Service) bool {
+	err := windows.ChangeServiceConfig(s.Handle, windows.SERVICE_NO_CHANGE, windows.SERVICE_NO_CHANGE, windows.SERVICE_NO_CHANGE, nil, nil, nil, nil, nil, nil, nil)
+	return errors.Is(err, windows.ERROR_SERVICE_MARKED_FOR_DELETE)
+}
+
+// PendingDeletion reports whether the service has been removed but is still
+// registered because some process holds a handle to it, which makes a new
+// install fail with ErrMarkedForDeletion. The SCM deletes it once the last
+// handle is closed: the handles of the wrapper are all closed when its calls
+// return, so WaitRemoved resolves it unless another process, such as an
+// open services.msc, keeps one. Checking needs change-config access.
+func (sw *ServiceWrapper) PendingDeletion() (bool, error) {
+	var marked bool
+	err := sw.withService(func(s *mgr.Service) error {
+		marked = markedForDeletion(s)
+		return nil
+	})
+	if errors.Is(err, ErrNotInstalled) {
+		return false, nil
+	}
+	return marked, err
+}
+
+// WaitRemoved waits up to timeout for a removed service to disappear from
+// the SCM, after which it can be installed again.
+func (sw *ServiceWrapper) WaitRemoved(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		installed, err := sw.IsInstalled()
+		if err != nil {
+			return err
+		}
+		if !installed {
+			return nil
+		}
+		if deadline.Before(time.Now()) {
+			return fmt.Errorf("timeout waiting for service %s to be removed", sw.serviceName)
+		}
+		time.Sleep(300 * time.Millisecond)
 	}
-	return nil
 }
@@ -0,0 +1,397 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+func TestMain(m *testing.M) {
+	// The SCM starts the test binary for the services installed by
+	// installTestService, which then serves them as idle services.
+	if inService, err := svc.IsWindowsService(); err == nil && inService {
+		sw, err := GetServiceWrapper(idle, "svchelper-test", "svchelper test", "", false)
+		if err == nil {
+			err = sw.ManageService()
+		}
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// requireAdmin skips the test unless the test binary runs elevated, as
+// installing services requires.
+func requireAdmin(t *testing.T) {
+	t.Helper()
+	if !windows.GetCurrentProcessToken().IsElevated() {
+		t.Skip("installing services requires an elevated process")
+	}
+}
+
+// newInstallWrapper returns a wrapper for a service named after the running
+// test, with the test binary as its executable. The name is passed on the
+// command line, so TestMain can serve it when the SCM starts the binary.
+func newInstallWrapper(t *testing.T, service Service, opts ...Option) *ServiceWrapper {
+	t.Helper()
+	opts = append([]Option{WithoutEventSourceRegistration()}, opts...)
+	sw := newTestWrapper(t, service, opts...)
+	name := "svchelper-test-" + strings.NewReplacer("/", "-", " ", "-").Replace(t.Name())
+	if err := sw.setServiceName(name); err != nil {
+		t.Fatalf("setServiceName failed: %v", err)
+	}
+	return sw
+}
+
+// installTestService installs the service of newInstallWrapper and removes
+// it again when the test ends.
+func installTestService(t *testing.T, opts ...Option) *ServiceWrapper {
+	t.Helper()
+	requireAdmin(t)
+	sw := newInstallWrapper(t, idle, opts...)
+	install(t, sw)
+	return sw
+}
+
+// install installs the service of sw and removes it again when the test
+// ends.
+func install(t *testing.T, sw *ServiceWrapper) {
+	t.Helper()
+	if err := sw.InstallService(); err != nil {
+		t.Fatalf("InstallService of %s failed: %v", sw.serviceName, err)
+	}
+	t.Cleanup(func() { removeTestService(t, sw) })
+}
+
+// removeTestService stops and removes the service of sw if it is still
+// installed, and waits for it to be gone.
+func removeTestService(t *testing.T, sw *ServiceWrapper) {
+	t.Helper()
+	installed, err := sw.IsInstalled()
+	if err != nil || !installed {
+		return
+	}
+	if status, err := sw.QueryStatus(); err == nil && status.State != svc.Stopped {
+		sw.ControlService(svc.Stop, svc.Stopped)
+	}
+	if err := sw.RemoveService(); err != nil {
+		t.Errorf("could not remove the test service: %v", err)
+	}
+	if err := sw.WaitRemoved(10 * time.Second); err != nil {
+		t.Errorf("the test service was not removed: %v", err)
+	}
+}
+
+// openTestService opens a handle of its own to the installed service of sw.
+func openTestService(t *testing.T, sw *ServiceWrapper) *mgr.Service {
+	t.Helper()
+	m, err := mgr.Connect()
+	if err != nil {
+		t.Fatalf("could not connect to the SCM: %v", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(sw.serviceName)
+	if err != nil {
+		t.Fatalf("could not open the test service: %v", err)
+	}
+	return s
+}
+
+func TestInstallMarkedForDeletion(t *testing.T) {
+	sw := installTestService(t)
+	s := openTestService(t, sw)
+	err := s.Delete()
+	if err == nil {
+		// The open handle keeps the deleted service registered.
+		err = sw.InstallService()
+	}
+	s.Close()
+	if !errors.Is(err, ErrMarkedForDeletion) {
+		t.Fatalf("InstallService of the deleted service returned %v, want ErrMarkedForDeletion", err)
+	}
+	if err := sw.WaitRemoved(10 * time.Second); err != nil {
+		t.Fatalf("the deleted service was not removed: %v", err)
+	}
+	if err := sw.InstallService(); err != nil {
+		t.Errorf("InstallService after the removal failed: %v", err)
+	}
+}
+
+func TestInstallHooks(t *testing.T) {
+	requireAdmin(t)
+	var sw *ServiceWrapper
+	var calls []string
+	hook := func(name string, wantInstalled bool) InstallHook {
+		return func(exePath string, config mgr.Config) error {
+			calls = append(calls, name)
+			if exe, _ := os.Executable(); !samePath(exePath, exe) {
+				t.Errorf("%s hook got the executable %s, want %s", name, exePath, exe)
+			}
+			if !strings.Contains(config.BinaryPathName, "auto-started") {
+				t.Errorf("%s hook got the command line %q", name, config.BinaryPathName)
+			}
+			if installed, err := sw.IsInstalled(); err != nil || installed != wantInstalled {
+				t.Errorf("%s hook ran with the service installed=%t (%v), want %t", name, installed, err, wantInstalled)
+			}
+			return nil
+		}
+	}
+	sw = newInstallWrapper(t, idle, WithPreInstall(hook("pre", false)), WithPostInstall(hook("post", true)))
+	install(t, sw)
+	if fmt.Sprint(calls) != "[pre post]" {
+		t.Errorf("hooks ran as %v, want [pre post]", calls)
+	}
+}
+
+func TestInstallHookFailures(t *testing.T) {
+	requireAdmin(t)
+	failure := errors.New("hook failed")
+	fail := func(string, mgr.Config) error { return failure }
+	for _, tt := range []struct {
+		desc string
+		opt  Option
+	}{
+		{desc: "pre-install", opt: WithPreInstall(fail)},
+		{desc: "post-install", opt: WithPostInstall(fail)},
+	} {
+		sw := newInstallWrapper(t, idle, tt.opt)
+		err := sw.InstallService()
+		if !errors.Is(err, failure) {
+			t.Errorf("%s: InstallService returned %v, want the hook error", tt.desc, err)
+		}
+		// A failing post-install hook rolls the service back.
+		if err := sw.WaitRemoved(10 * time.Second); err != nil {
+			t.Errorf("%s: the service was left installed: %v", tt.desc, err)
+			removeTestService(t, sw)
+		}
+	}
+}
+
+func TestRemoveHooks(t *testing.T) {
+	requireAdmin(t)
+	var calls []string
+	hook := func(name string, err error) RemoveHook {
+		return func(serviceName, exePath string) error {
+			calls = append(calls, name)
+			if exe, _ := os.Executable(); !samePath(exePath, exe) {
+				t.Errorf("%s hook got the executable %s, want %s", name, exePath, exe)
+			}
+			if !strings.HasPrefix(serviceName, "svchelper-test-") {
+				t.Errorf("%s hook got the service name %s", name, serviceName)
+			}
+			return err
+		}
+	}
+	failure := errors.New("hook failed")
+
+	sw := newInstallWrapper(t, idle, WithPreRemove(hook("pre", failure)), WithPostRemove(hook("post", nil)))
+	install(t, sw)
+	if err := sw.RemoveService(); !errors.Is(err, failure) {
+		t.Errorf("RemoveService returned %v, want the pre-remove error", err)
+	}
+	if installed, err := sw.IsInstalled(); err != nil || !installed {
+		t.Errorf("a failing pre-remove hook did not keep the service: installed=%t (%v)", installed, err)
+	}
+	if fmt.Sprint(calls) != "[pre]" {
+		t.Errorf("hooks ran as %v, want [pre]", calls)
+	}
+
+	// A failing post-remove hook is only reported, the service is gone.
+	calls = nil
+	sw.preRemove, sw.postRemove = hook("pre", nil), hook("post", failure)
+	if err := sw.RemoveService(); err != nil {
+		t.Errorf("RemoveService failed: %v", err)
+	}
+	if fmt.Sprint(calls) != "[pre post]" {
+		t.Errorf("hooks ran as %v, want [pre post]", calls)
+	}
+	if err := sw.WaitRemoved(10 * time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpdateBinaryPath(t *testing.T) {
+	requireAdmin(t)
+	moved := filepath.Join(os.Getenv("SystemRoot"), "System32", "svchost.exe")
+	if err := newInstallWrapper(t, idle).UpdateBinaryPath(moved); !errors.Is(err, ErrNotInstalled) {
+		t.Errorf("UpdateBinaryPath of a missing service returned %v, want ErrNotInstalled", err)
+	}
+	sw := installTestService(t)
+	_, wantArgs, err := sw.InstalledCommandLine()
+	if err != nil {
+		t.Fatalf("InstalledCommandLine failed: %v", err)
+	}
+	if err := sw.UpdateBinaryPath(moved); err != nil {
+		t.Fatalf("UpdateBinaryPath failed: %v", err)
+	}
+	program, args, err := sw.InstalledCommandLine()
+	if err != nil {
+		t.Fatalf("InstalledCommandLine failed: %v", err)
+	}
+	if !samePath(program, moved) {
+		t.Errorf("the service runs %s, want %s", program, moved)
+	}
+	if fmt.Sprint(args) != fmt.Sprint(wantArgs) {
+		t.Errorf("the service has the arguments %q, want them kept as %q", args, wantArgs)
+	}
+	if err := sw.UpdateBinaryPath(filepath.Dir(moved)); err == nil {
+		t.Error("UpdateBinaryPath to a directory succeeded")
+	}
+}
+
+func TestInstallStartType(t *testing.T) {
+	driver := filepath.Join(t.TempDir(), "svchelper-test.sys")
+	if err := os.WriteFile(driver, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		desc      string
+		startType uint32
+		opts      []Option
+	}{
+		{desc: "automatic", startType: mgr.StartAutomatic},
+		{desc: "manual", startType: mgr.StartManual},
+		{desc: "disabled", startType: mgr.StartDisabled},
+		{desc: "boot", startType: windows.SERVICE_BOOT_START,
+			opts: []Option{WithServiceType(windows.SERVICE_KERNEL_DRIVER), WithDriverPath(driver)}},
+		{desc: "system", startType: windows.SERVICE_SYSTEM_START,
+			opts: []Option{WithServiceType(windows.SERVICE_KERNEL_DRIVER), WithDriverPath(driver)}},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			sw := installTestService(t, append(tc.opts, WithStartType(tc.startType))...)
+			s := openTestService(t, sw)
+			defer s.Close()
+			config, err := s.Config()
+			if err != nil {
+				t.Fatalf("could not read the service config: %v", err)
+			}
+			if config.StartType != tc.startType {
+				t.Errorf("the service is installed with start type %s, want %s",
+					startTypeString(config.StartType), startTypeString(tc.startType))
+			}
+		})
+	}
+}
+
+func TestInstallDisabledThenEnable(t *testing.T) {
+	requireAdmin(t)
+	sw := newInstallWrapper(t, idle)
+	if err := sw.InstallDisabled(); err != nil {
+		t.Fatalf("InstallDisabled failed: %v", err)
+	}
+	t.Cleanup(func() { removeTestService(t, sw) })
+	if sw.startType != mgr.StartAutomatic {
+		t.Errorf("InstallDisabled left the start type of the wrapper at %s", startTypeString(sw.startType))
+	}
+	info, err := sw.ServiceInfo()
+	if err != nil {
+		t.Fatalf("ServiceInfo failed: %v", err)
+	}
+	if info.StartType != mgr.StartDisabled {
+		t.Errorf("the service is installed with start type %s, want disabled", startTypeString(info.StartType))
+	}
+	// startServiceWithArgs reports the error of the SCM by its message.
+	if err := sw.StartService(); err == nil || !strings.Contains(err.Error(), windows.ERROR_SERVICE_DISABLED.Error()) {
+		t.Errorf("StartService of the disabled service returned %v, want ERROR_SERVICE_DISABLED", err)
+	}
+
+	if err := sw.EnableService(); err != nil {
+		t.Fatalf("EnableService failed: %v", err)
+	}
+	if info, err = sw.ServiceInfo(); err != nil {
+		t.Fatalf("ServiceInfo failed: %v", err)
+	}
+	if info.StartType != mgr.StartAutomatic {
+		t.Errorf("EnableService set start type %s, want automatic", startTypeString(info.StartType))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := sw.StartServiceContext(ctx); err != nil {
+		t.Fatalf("StartServiceContext of the enabled service failed: %v", err)
+	}
+	if err := sw.ControlService(svc.Stop, svc.Stopped); err != nil {
+		t.Errorf("ControlService(Stop) failed: %v", err)
+	}
+}
+
+var procGetProcessHandleCount = modkernel32.NewProc("GetProcessHandleCount")
+
+// processHandleCount returns the number of handles the test process holds.
+func processHandleCount(t *testing.T) uint32 {
+	t.Helper()
+	var count uint32
+	r, _, err := procGetProcessHandleCount.Call(uintptr(windows.CurrentProcess()), uintptr(unsafe.Pointer(&count)))
+	if r == 0 {
+		t.Fatalf("GetProcessHandleCount failed: %v", err)
+	}
+	return count
+}
+
+func TestFailedInstallLeaksNoHandles(t *testing.T) {
+	requireAdmin(t)
+	failure := errors.New("hook failed")
+	fail := func(string, mgr.Config) error { return failure }
+	existing := installTestService(t)
+	failing := func(suffix string, opt Option) *ServiceWrapper {
+		sw := newInstallWrapper(t, idle, opt)
+		if err := sw.setServiceName(sw.serviceName + "-" + suffix); err != nil {
+			t.Fatalf("setServiceName failed: %v", err)
+		}
+		return sw
+	}
+	failures := []struct {
+		desc string
+		sw   *ServiceWrapper
+	}{
+		{desc: "pre-install", sw: failing("pre", WithPreInstall(fail))},
+		{desc: "post-install", sw: failing("post", WithPostInstall(fail))},
+		{desc: "existing service", sw: existing},
+	}
+	installAll := func() {
+		for _, f := range failures {
+			if err := f.sw.InstallService(); err == nil {
+				t.Fatalf("%s: InstallService succeeded", f.desc)
+			}
+			// A handle to the rolled back service left open would keep it
+			// marked for deletion.
+			if f.sw != existing {
+				if err := f.sw.WaitRemoved(10 * time.Second); err != nil {
+					removeTestService(t, f.sw)
+					t.Fatalf("%s: the service was not removed: %v", f.desc, err)
+				}
+			}
+		}
+	}
+	// The first round loads the DLLs and caches the handles the process
+	// keeps for good.
+	installAll()
+	before := processHandleCount(t)
+	const rounds = 5
+	for i := 0; i < rounds; i++ {
+		installAll()
+	}
+	// A leak of one handle per failed install grows the count by at least
+	// rounds; allow for handles the runtime opens meanwhile.
+	if after := processHandleCount(t); after >= before+rounds {
+		t.Errorf("the process holds %d handles after %d rounds of failed installs, %d before", after, rounds, before)
+	}
+}
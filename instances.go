@@ -0,0 +1,128 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// ListInstances returns the installed services whose name starts with prefix
+// and whose image path is this binary, as resolved by ExePath. Services the
+// caller is not allowed to query are skipped.
+func (sw *ServiceWrapper) ListInstances(prefix string) ([]string, error) {
+	exepath, err := sw.ExePath()
+	if err != nil {
+		return nil, fmt.Errorf("when resolving the executable path: %w", err)
+	}
+	m, err := sw.connectReadOnly()
+	if err != nil {
+		return nil, err
+	}
+	defer m.Disconnect()
+	names, err := m.ListServices()
+	if err != nil {
+		return nil, fmt.Errorf("could not list services: %v", err)
+	}
+	var instances []string
+	for _, name := range names {
+		if !strings.HasPrefix(strings.ToLower(name), strings.ToLower(prefix)) {
+			continue
+		}
+		program, err := imageProgram(m, name)
+		if errors.Is(err, windows.ERROR_ACCESS_DENIED) || errors.Is(err, windows.ERROR_SERVICE_DOES_NOT_EXIST) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if samePath(program, exepath) {
+			instances = append(instances, name)
+		}
+	}
+	return instances, nil
+}
+
+// maxInstanceConcurrency bounds how many instances StartAllInstances and
+// StopAllInstances control at once.
+const maxInstanceConcurrency = 4
+
+// StartAllInstances starts every instance listed by ListInstances for
+// prefix, without waiting for them to run. The returned error names each
+// instance that failed.
+func (sw *ServiceWrapper) StartAllInstances(prefix string) error {
+	return sw.forAllInstances(prefix, func(name string) error {
+		return sw.startService(context.Background(), name, false)
+	})
+}
+
+// StopAllInstances stops every instance listed by ListInstances for prefix
+// and waits for each to be stopped. The returned error names each instance
+// that failed.
+func (sw *ServiceWrapper) StopAllInstances(prefix string) error {
+	return sw.forAllInstances(prefix, func(name string) error {
+		return sw.controlService(context.Background(), name, svc.Stop, []svc.State{svc.Stopped})
+	})
+}
+
+func (sw *ServiceWrapper) forAllInstances(prefix string, f func(name string) error) error {
+	instances, err := sw.ListInstances(prefix)
+	if err != nil {
+		return err
+	}
+	errs := make([]error, len(instances))
+	limit := make(chan struct{}, maxInstanceConcurrency)
+	var wg sync.WaitGroup
+	for i, name := range instances {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			if err := f(name); err != nil {
+				errs[i] = fmt.Errorf("instance %s: %w", name, err)
+			}
+		}(i, name)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// imageProgram returns the program of the image path of the named service,
+// opening it with query access only.
+func imageProgram(m *mgr.Mgr, name string) (string, error) {
+	h, err := windows.OpenService(m.Handle, syscall.StringToUTF16Ptr(name), windows.SERVICE_QUERY_CONFIG)
+	if err != nil {
+		return "", err
+	}
+	s := &mgr.Service{Name: name, Handle: h}
+	defer s.Close()
+	config, err := s.Config()
+	if err != nil {
+		return "", fmt.Errorf("could not retrieve config of %s: %w", name, err)
+	}
+	commandLine, err := windows.DecomposeCommandLine(config.BinaryPathName)
+	if err != nil || len(commandLine) == 0 {
+		return "", nil
+	}
+	return commandLine[0], nil
+}
+
+// samePath compares two Windows paths the way the file system does.
+func samePath(a, b string) bool {
+	return strings.EqualFold(filepath.Clean(a), filepath.Clean(b))
+}
@@ -0,0 +1,59 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestListInstances(t *testing.T) {
+	requireAdmin(t)
+	base := newInstallWrapper(t, idle)
+	prefix := base.serviceName + "-"
+	other := func() (string, error) {
+		return filepath.Join(os.Getenv("SystemRoot"), "System32", "svchost.exe"), nil
+	}
+	for _, instance := range []struct {
+		suffix string
+		opts   []Option
+	}{
+		{suffix: "a"},
+		{suffix: "b"},
+		{suffix: "other-binary", opts: []Option{WithExePathResolver(other)}},
+	} {
+		sw := newInstallWrapper(t, idle, instance.opts...)
+		if err := sw.setServiceName(prefix + instance.suffix); err != nil {
+			t.Fatalf("setServiceName failed: %v", err)
+		}
+		install(t, sw)
+	}
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{prefix: prefix, want: []string{prefix + "a", prefix + "b"}},
+		{prefix: strings.ToUpper(prefix), want: []string{prefix + "a", prefix + "b"}},
+		{prefix: prefix + "b", want: []string{prefix + "b"}},
+		{prefix: prefix + "other", want: nil},
+	}
+	for _, tt := range tests {
+		got, err := base.ListInstances(tt.prefix)
+		if err != nil {
+			t.Fatalf("ListInstances(%q) failed: %v", tt.prefix, err)
+		}
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("ListInstances(%q) = %v, want %v", tt.prefix, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// minProgressInterval caps the rate of Lifecycle.ReportProgress updates.
+const minProgressInterval = time.Second
+
+// Lifecycle lets a running service interact with the wrapper running it.
+// A service receives it by implementing LifecycleAware.
+type Lifecycle struct {
+	ctx      context.Context
+	failOnce sync.Once
+	failed   chan struct{}
+	err      error
+	status   *statusReporter
+	params   any
+
+	recoveryStart bool
+
+	progressMu   sync.Mutex
+	lastProgress time.Time
+}
+
+// LifecycleAware can optionally be implemented by a Service to receive the
+// Lifecycle of a run before Schedule is called.
+type LifecycleAware interface {
+	SetLifecycle(lifecycle *Lifecycle)
+}
+
+// ExitCoder can be implemented by errors passed to Lifecycle.Fail or
+// returned by ExitErrorer to choose the service-specific exit code reported
+// to the SCM, for example to drive recovery actions.
+type ExitCoder interface {
+	ExitCode() uint32
+}
+
+func newLifecycle(ctx context.Context, status *statusReporter) *Lifecycle {
+	return &Lifecycle{ctx: ctx, failed: make(chan struct{}), status: status}
+}
+
+// Context returns the context of the run, the one passed to Schedule. It is
+// cancelled when the service stops and stays cancelled after the run.
+func (l *Lifecycle) Context() context.Context {
+	return l.ctx
+}
+
+// Parameters returns the struct set by WithParameters, filled from the
+// Parameters registry key before Schedule was called, or nil.
+func (l *Lifecycle) Parameters() any {
+	return l.params
+}
+
+// Fail stops the running service because of an unrecoverable error. The
+// service exits with a non-zero code, so the SCM recovery actions fire.
+// Only the first call has an effect.
+func (l *Lifecycle) Fail(err error) {
+	if err == nil {
+		err = errors.New("service failed")
+	}
+	l.failOnce.Do(func() {
+		l.err = err
+		close(l.failed)
+	})
+}
+
+// ReportProgress publishes the progress of lengthy work done while running
+// as the checkpoint and wait hint of the Running status, for monitoring. It
+// is purely informational: the SCM only acts on checkpoints of pending
+// states, but tools reading the status may be confused by frequent changes,
+// so updates within a second of the previous one are dropped, as are those
+// made while the service is not running.
+func (l *Lifecycle) ReportProgress(checkpoint uint32, hint time.Duration) {
+	l.progressMu.Lock()
+	defer l.progressMu.Unlock()
+	if time.Since(l.lastProgress) < minProgressInterval {
+		return
+	}
+	status := l.status.status()
+	status.CheckPoint = checkpoint
+	status.WaitHint = uint32(hint / time.Millisecond)
+	if l.status.reportIfRunning(status) {
+		l.lastProgress = time.Now()
+	}
+}
+
+// IsRecoveryStart reports whether the previous run of the service under the
+// SCM did not stop cleanly: it crashed, failed through Fail or a fatal
+// ExitError, or exited with a non-zero code. That is the case when the SCM
+// restarts the service as a recovery action, letting the service back off
+// or raise an alert. The SCM does not tell recovery starts apart, so this is
+// a heuristic: a manual start, or the start after a reboot, that follows a
+// failed run counts as well, and a run that cannot write its marker to the
+// Parameters key is never reported as one. Debug and foreground runs always
+// report false.
+func (l *Lifecycle) IsRecoveryStart() bool {
+	return l.recoveryStart
+}
+
+// exitCode maps a fatal error to the exit code reported to the SCM: the
+// service-specific code of an ExitCoder, or else the generic code 1.
+func exitCode(err error) (ssec bool, errno uint32) {
+	var exitCoder ExitCoder
+	if errors.As(err, &exitCoder) && exitCoder.ExitCode() != 0 {
+		return true, exitCoder.ExitCode()
+	}
+	return false, 1
+}
@@ -0,0 +1,76 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// startLivenessFile touches the liveness file every interval while the
+// service is running and healthy, and removes it once ctx is done. The
+// goroutine is added to wg.
+func (sw *ServiceWrapper) startLivenessFile(ctx context.Context, wg *sync.WaitGroup, status *statusReporter) error {
+	path, err := resolvePath(sw.livenessPath)
+	if err != nil {
+		return err
+	}
+	if err := touchLivenessFile(path); err != nil {
+		return err
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				elog.Warning(1, fmt.Sprintf("When removing the liveness file of the service '%s': %s", sw.serviceName, err))
+			}
+		}()
+		ticker := time.NewTicker(sw.livenessInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if status.status().State != svc.Running {
+					continue
+				}
+				if checker, ok := sw.service.(HealthChecker); ok && checker.Healthy() != nil {
+					continue
+				}
+				if err := touchLivenessFile(path); err != nil {
+					elog.Warning(1, fmt.Sprintf("When touching the liveness file of the service '%s': %s", sw.serviceName, err))
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// touchLivenessFile sets the modification time of the file at path to now,
+// creating it if needed.
+func touchLivenessFile(path string) error {
+	now := time.Now()
+	err := os.Chtimes(path, now, now)
+	if os.IsNotExist(err) {
+		var f *os.File
+		if f, err = os.Create(path); err == nil {
+			err = f.Close()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("when touching the liveness file %s: %w", path, err)
+	}
+	return nil
+}
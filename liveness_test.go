@@ -0,0 +1,87 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// toggledHealth is a HealthChecker that is unhealthy while sick is set.
+type toggledHealth struct {
+	Service
+	sick atomic.Bool
+}
+
+func (h *toggledHealth) Healthy() error {
+	if h.sick.Load() {
+		return errors.New("sick")
+	}
+	return nil
+}
+
+// modTime returns the modification time of the file at path.
+func modTime(t *testing.T, path string) time.Time {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("the liveness file is missing: %v", err)
+	}
+	return info.ModTime()
+}
+
+// touches counts how often the file at path is touched during d.
+func touches(t *testing.T, path string, d time.Duration) int {
+	t.Helper()
+	last, n := modTime(t, path), 0
+	for deadline := time.Now().Add(d); time.Now().Before(deadline); time.Sleep(2 * time.Millisecond) {
+		if m := modTime(t, path); !m.Equal(last) {
+			last = m
+			n++
+		}
+	}
+	return n
+}
+
+func TestLivenessFile(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	path := filepath.Join(t.TempDir(), "alive")
+	service := &toggledHealth{Service: idle}
+	e := newExecution()
+	sw := newTestWrapper(t, service, WithStatusObserver(e.observe), WithLivenessFile(path, interval))
+	e.start(sw)
+	e.waitFor(t, svc.Running)
+
+	// 15 intervals leave plenty of slack for a loaded machine.
+	if n := touches(t, path, 15*interval); n < 3 {
+		t.Errorf("the liveness file was touched %d times in %s, want one every %s", n, 15*interval, interval)
+	}
+	service.sick.Store(true)
+	time.Sleep(2 * interval) // for a touch already under way
+	if n := touches(t, path, 10*interval); n > 0 {
+		t.Errorf("the liveness file was touched %d times while unhealthy", n)
+	}
+	service.sick.Store(false)
+	if n := touches(t, path, 15*interval); n == 0 {
+		t.Error("the liveness file was not touched again once healthy")
+	}
+
+	e.send(svc.Stop)
+	if _, errno := e.wait(t); errno != 0 {
+		t.Errorf("Execute returned errno %d, want 0", errno)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the liveness file is left after the stop: %v", err)
+	}
+}
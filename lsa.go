@@ -0,0 +1,134 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"fmt"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	serviceLogonRight = "SeServiceLogonRight"
+
+	policyCreateAccount = 0x00000010
+	policyLookupNames   = 0x00000800
+)
+
+var (
+	modadvapi32             = windows.NewLazySystemDLL("advapi32.dll")
+	procLsaOpenPolicy       = modadvapi32.NewProc("LsaOpenPolicy")
+	procLsaClose            = modadvapi32.NewProc("LsaClose")
+	procLsaAddAccountRights = modadvapi32.NewProc("LsaAddAccountRights")
+
+	procLsaEnumerateAccountRights = modadvapi32.NewProc("LsaEnumerateAccountRights")
+	procLsaFreeMemory             = modadvapi32.NewProc("LsaFreeMemory")
+)
+
+func lsaError(status uintptr) error {
+	if status == 0 {
+		return nil
+	}
+	return windows.NTStatus(status).Errno()
+}
+
+// openPolicy opens the LSA policy of host, or of the local machine when host
+// is empty.
+func openPolicy(host string, access uint32) (windows.Handle, error) {
+	var systemName *windows.NTUnicodeString
+	if host != "" {
+		var err error
+		if systemName, err = windows.NewNTUnicodeString(host); err != nil {
+			return 0, err
+		}
+	}
+	attributes := windows.OBJECT_ATTRIBUTES{Length: uint32(unsafe.Sizeof(windows.OBJECT_ATTRIBUTES{}))}
+	var policy windows.Handle
+	r, _, _ := procLsaOpenPolicy.Call(uintptr(unsafe.Pointer(systemName)), uintptr(unsafe.Pointer(&attributes)), uintptr(access), uintptr(unsafe.Pointer(&policy)))
+	if err := lsaError(r); err != nil {
+		return 0, fmt.Errorf("LsaOpenPolicy() failed: %w", err)
+	}
+	return policy, nil
+}
+
+func closePolicy(policy windows.Handle) {
+	procLsaClose.Call(uintptr(policy))
+}
+
+// lookupAccountSID returns the SID of account on host. The SCM accepts the
+// ".\user" form for local accounts, which LookupAccountName does not, so
+// the dot is replaced by the name of the machine first.
+func lookupAccountSID(host, account string) (*windows.SID, error) {
+	if strings.HasPrefix(account, `.\`) {
+		machine := strings.TrimPrefix(host, `\\`)
+		if machine == "" {
+			var err error
+			if machine, err = windows.ComputerName(); err != nil {
+				return nil, fmt.Errorf("when getting the computer name: %w", err)
+			}
+		}
+		account = machine + account[1:]
+	}
+	sid, _, _, err := windows.LookupSID(host, account)
+	return sid, err
+}
+
+// grantAccountRight grants right to account through the LSA policy of host.
+func grantAccountRight(host, account, right string) error {
+	sid, err := lookupAccountSID(host, account)
+	if err != nil {
+		return fmt.Errorf("when looking up account %s: %w", account, err)
+	}
+	policy, err := openPolicy(host, policyLookupNames|policyCreateAccount)
+	if err != nil {
+		return err
+	}
+	defer closePolicy(policy)
+	rights, err := windows.NewNTUnicodeString(right)
+	if err != nil {
+		return err
+	}
+	r, _, _ := procLsaAddAccountRights.Call(uintptr(policy), uintptr(unsafe.Pointer(sid)), uintptr(unsafe.Pointer(rights)), 1)
+	if err := lsaError(r); err != nil {
+		return fmt.Errorf("LsaAddAccountRights() failed for %s: %w", account, err)
+	}
+	return nil
+}
+
+// hasAccountRight reports whether account holds right in the LSA policy of
+// host. Rights held through a group membership are not seen.
+func hasAccountRight(host, account, right string) (bool, error) {
+	sid, err := lookupAccountSID(host, account)
+	if err != nil {
+		return false, fmt.Errorf("when looking up account %s: %w", account, err)
+	}
+	policy, err := openPolicy(host, policyLookupNames)
+	if err != nil {
+		return false, err
+	}
+	defer closePolicy(policy)
+	var rights *windows.NTUnicodeString
+	var count uint32
+	r, _, _ := procLsaEnumerateAccountRights.Call(uintptr(policy), uintptr(unsafe.Pointer(sid)), uintptr(unsafe.Pointer(&rights)), uintptr(unsafe.Pointer(&count)))
+	if windows.NTStatus(r) == windows.STATUS_OBJECT_NAME_NOT_FOUND {
+		// The account holds no rights at all.
+		return false, nil
+	}
+	if err := lsaError(r); err != nil {
+		return false, fmt.Errorf("LsaEnumerateAccountRights() failed for %s: %w", account, err)
+	}
+	defer procLsaFreeMemory.Call(uintptr(unsafe.Pointer(rights)))
+	for _, held := range unsafe.Slice(rights, count) {
+		if strings.EqualFold(held.String(), right) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
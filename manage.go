@@ -8,65 +8,356 @@
 package svchelper
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
+	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/svc"
 	"golang.org/x/sys/windows/svc/mgr"
 )
 
-func (sw *ServiceWrapper) usage(errmsg string) {
-	fmt.Fprintf(os.Stderr,
+const (
+	serviceNameFlag = "--service-name"
+	jsonFlag        = "--json"
+)
+
+// Command describes a management command of ManageService, for a host CLI
+// rendering its own help or routing to the wrapper.
+type Command struct {
+	Name        string
+	Args        string // the arguments it takes, e.g. "<level>"
+	Description string
+}
+
+// commands are the management commands in the order of the usage text.
+var commands = []Command{
+	{Name: "install", Description: "install the service"},
+	{Name: "remove", Description: "remove the service"},
+	{Name: "reinstall", Description: "remove and install the service, keeping its settings"},
+	{Name: "reconfigure", Description: "apply the configuration to the installed service"},
+	{Name: "enable", Description: "set the start type of a disabled service"},
+	{Name: "debug", Description: "run the service in the console with the arguments that follow"},
+	{Name: "start", Description: "start the service"},
+	{Name: "stop", Description: "stop the service"},
+	{Name: "pause", Description: "pause the service"},
+	{Name: "continue", Description: "continue the paused service"},
+	{Name: "drain", Description: "make the service finish its work and stop taking new work"},
+	{Name: "info", Description: "print the service configuration and state"},
+	{Name: "status", Description: "print the service state"},
+	{Name: "preflight", Description: "check the prerequisites of install"},
+	{Name: "loglevel", Args: "<level>", Description: "change the log level of the running service"},
+	{Name: "diagnostics", Args: "[file]", Description: "write a support report"},
+	{Name: "selftest", Description: "run the self-test of the service"},
+}
+
+// Commands returns the management commands ManageService dispatches.
+func Commands() []Command {
+	return append([]Command(nil), commands...)
+}
+
+func isCommand(arg string) bool {
+	for _, cmd := range commands {
+		if strings.EqualFold(arg, cmd.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// commandList renders the commands as the indented, wrapped list of the
+// usage text.
+func commandList() string {
+	const indent, width = "       ", 72
+	var b strings.Builder
+	line := indent
+	for i, cmd := range commands {
+		item := cmd.Name
+		if cmd.Args != "" {
+			item += " " + cmd.Args
+		}
+		switch {
+		case i == len(commands)-1:
+			item += "."
+		case i == len(commands)-2:
+			item += " or"
+		default:
+			item += ","
+		}
+		if line != indent && len(line)+1+len(item) > width {
+			b.WriteString(line + "\n")
+			line = indent
+		}
+		if line != indent {
+			line += " "
+		}
+		line += item
+	}
+	b.WriteString(line + "\n")
+	return b.String()
+}
+
+// resolveCommand maps a configured alias onto its command.
+func (sw *ServiceWrapper) resolveCommand(arg string) string {
+	cmd := strings.ToLower(arg)
+	if aliased, ok := sw.commandAliases[cmd]; ok {
+		return aliased
+	}
+	return cmd
+}
+
+// usage prints the usage text after errmsg to stderr and returns an error
+// wrapping ErrUsage.
+func (sw *ServiceWrapper) usage(errmsg string) error {
+	sw.writeUsage(os.Stderr, errmsg)
+	return fmt.Errorf("%s: %w", errmsg, ErrUsage)
+}
+
+func (sw *ServiceWrapper) writeUsage(w io.Writer, errmsg string) {
+	fmt.Fprintf(w,
 		"%s\n\n"+
-			"usage: %s <command>\n"+
+			"usage: %s [%s <name>] [%s] <command> [arguments...]\n"+
 			"       where <command> is one of\n"+
-			"       install, remove, debug, start, stop, pause or continue.\n",
-		errmsg, os.Args[0])
-	os.Exit(2)
+			"%s",
+		errmsg, os.Args[0], serviceNameFlag, jsonFlag, commandList())
+	if len(sw.commandAliases) > 0 {
+		aliases := make([]string, 0, len(sw.commandAliases))
+		for alias, cmd := range sw.commandAliases {
+			aliases = append(aliases, fmt.Sprintf("%s (%s)", alias, cmd))
+		}
+		sort.Strings(aliases)
+		fmt.Fprintf(w, "       aliases: %s.\n", strings.Join(aliases, ", "))
+	}
+}
+
+func (sw *ServiceWrapper) setServiceName(name string) error {
+	name, err := normalizeServiceName(name)
+	if err != nil {
+		return err
+	}
+	sw.serviceName = name
+	sw.serviceNameOverridden = true
+	if sw.virtualAccount {
+		sw.serviceAccount = virtualAccountPrefix + name
+	}
+	return nil
 }
 
+// parseFlags consumes the wrapper flags preceding the command and returns
+// the remaining arguments.
+func (sw *ServiceWrapper) parseFlags(args []string) ([]string, error) {
+	for len(args) > 0 {
+		switch arg := args[0]; {
+		case arg == serviceNameFlag:
+			if len(args) < 2 {
+				return nil, fmt.Errorf("%s requires a value", serviceNameFlag)
+			}
+			if err := sw.setServiceName(args[1]); err != nil {
+				return nil, err
+			}
+			args = args[2:]
+		case strings.HasPrefix(arg, serviceNameFlag+"="):
+			if err := sw.setServiceName(strings.TrimPrefix(arg, serviceNameFlag+"=")); err != nil {
+				return nil, err
+			}
+			args = args[1:]
+		case arg == jsonFlag:
+			sw.jsonOutput = true
+			args = args[1:]
+		default:
+			return args, nil
+		}
+	}
+	return args, nil
+}
+
+// ManageService runs the management command on the command line, or the
+// service if the SCM started the process. For a command line it cannot run
+// it prints the usage text and returns an error wrapping ErrUsage.
 func (sw *ServiceWrapper) ManageService() error {
-	inService, err := svc.IsWindowsService()
+	args, err := sw.parseFlags(os.Args[1:])
 	if err != nil {
-		return fmt.Errorf("failed to determine if we are running in service: %w", err)
+		return sw.usage(err.Error())
 	}
-	if inService {
-		return sw.RunService(false)
+
+	// A management command is dispatched without asking whether we run
+	// under the SCM, as that detection is unreliable on some systems.
+	if len(args) < 1 || !isCommand(sw.resolveCommand(args[0])) {
+		inService, err := svc.IsWindowsService()
+		if err != nil {
+			return fmt.Errorf("failed to determine if we are running in service: %w", err)
+		}
+		if inService {
+			return sw.RunService(false)
+		}
 	}
 
-	if len(os.Args) < 2 {
-		sw.usage("no command specified")
+	if len(args) < 1 {
+		return sw.usage("no command specified")
 	}
 
-	cmd := strings.ToLower(os.Args[1])
-	switch cmd {
-	case "debug":
+	cmd := sw.resolveCommand(args[0])
+	if cmd == "debug" {
+		sw.debugArgs = append([]string{}, args[1:]...)
 		err = sw.RunService(true)
+	} else {
+		err = sw.runManagementCommand(cmd, args)
+	}
+	if errors.Is(err, ErrUsage) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to %s %s: %w", cmd, sw.serviceName, err)
+	}
+	return nil
+}
+
+// runManagementCommand runs cmd, abandoning it with an error if it does not
+// complete within the WithManagementTimeout timeout.
+func (sw *ServiceWrapper) runManagementCommand(cmd string, args []string) error {
+	if sw.managementTimeout <= 0 {
+		return sw.dispatch(context.Background(), cmd, args)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sw.managementTimeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- sw.dispatch(ctx, cmd, args) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("no result within %s, the SCM may be unresponsive", sw.managementTimeout)
+	}
+}
+
+// dispatch runs a management command. The waits of the commands are bound
+// by ctx; the SCM calls themselves cannot be interrupted.
+func (sw *ServiceWrapper) dispatch(ctx context.Context, cmd string, args []string) error {
+	handler := commandHandler(cmd)
+	if handler == nil {
+		return sw.usage(fmt.Sprintf("invalid command %s", cmd))
+	}
+	return handler(sw, ctx, args)
+}
+
+// commandHandler returns the function running the management command cmd,
+// or nil if there is none. debug is run by ManageService itself, as it is
+// not bound by the management timeout.
+func commandHandler(cmd string) func(sw *ServiceWrapper, ctx context.Context, args []string) error {
+	switch cmd {
 	case "install":
-		err = sw.InstallService()
+		return func(sw *ServiceWrapper, ctx context.Context, args []string) error { return sw.InstallService() }
+	case "preflight":
+		return func(sw *ServiceWrapper, ctx context.Context, args []string) error { return sw.printPreflight() }
 	case "remove":
-		err = sw.RemoveService()
+		return func(sw *ServiceWrapper, ctx context.Context, args []string) error { return sw.RemoveService() }
+	case "reinstall":
+		return func(sw *ServiceWrapper, ctx context.Context, args []string) error { return sw.Reinstall() }
+	case "reconfigure":
+		return func(sw *ServiceWrapper, ctx context.Context, args []string) error { return sw.Reconfigure() }
+	case "enable":
+		return func(sw *ServiceWrapper, ctx context.Context, args []string) error { return sw.EnableService() }
 	case "start":
-		err = sw.StartService()
+		return func(sw *ServiceWrapper, ctx context.Context, args []string) error { return sw.StartService() }
 	case "stop":
-		err = sw.ControlService(svc.Stop, svc.Stopped)
+		return func(sw *ServiceWrapper, ctx context.Context, args []string) error {
+			return sw.controlService(ctx, sw.serviceName, svc.Stop, []svc.State{svc.Stopped})
+		}
 	case "pause":
-		err = sw.ControlService(svc.Pause, svc.Paused)
+		return func(sw *ServiceWrapper, ctx context.Context, args []string) error {
+			return sw.controlService(ctx, sw.serviceName, svc.Pause, []svc.State{svc.Paused})
+		}
 	case "continue":
-		err = sw.ControlService(svc.Continue, svc.Running)
-	default:
-		sw.usage(fmt.Sprintf("invalid command %s", cmd))
+		return func(sw *ServiceWrapper, ctx context.Context, args []string) error {
+			return sw.controlService(ctx, sw.serviceName, svc.Continue, []svc.State{svc.Running})
+		}
+	case "drain":
+		return func(sw *ServiceWrapper, ctx context.Context, args []string) error { return sw.DrainService() }
+	case "info":
+		return func(sw *ServiceWrapper, ctx context.Context, args []string) error { return sw.printInfo() }
+	case "status":
+		return func(sw *ServiceWrapper, ctx context.Context, args []string) error { return sw.printStatus() }
+	case "selftest":
+		return func(sw *ServiceWrapper, ctx context.Context, args []string) error { return sw.runSelfTest(ctx) }
+	case "diagnostics":
+		return func(sw *ServiceWrapper, ctx context.Context, args []string) error {
+			path := ""
+			if len(args) > 1 {
+				path = args[1]
+			}
+			return sw.writeDiagnostics(path)
+		}
+	case "loglevel":
+		return func(sw *ServiceWrapper, ctx context.Context, args []string) error {
+			if len(args) < 2 {
+				return sw.usage("no log level specified")
+			}
+			return sw.SetLogLevel(args[1])
+		}
+	}
+	return nil
+}
+
+// printJSON prints StatusJSON, which the info and status commands share
+// when --json is given.
+func (sw *ServiceWrapper) printJSON() error {
+	b, err := sw.StatusJSON()
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+func (sw *ServiceWrapper) printInfo() error {
+	if sw.jsonOutput {
+		return sw.printJSON()
+	}
+	info, err := sw.WrapperInfo()
+	fmt.Printf("service name: %s\n", info.ServiceName)
+	fmt.Printf("display name: %s\n", info.DisplayName)
+	fmt.Printf("description:  %s\n", info.Description)
+	fmt.Printf("exe path:     %s\n", info.ExePath)
+	fmt.Printf("start type:   %s\n", startTypeString(info.StartType))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("installed:    %t\n", info.Installed)
+	if info.Installed {
+		fmt.Printf("state:        %s\n", StateString(info.State))
+	}
+	return nil
+}
+
+func (sw *ServiceWrapper) printStatus() error {
+	if sw.jsonOutput {
+		return sw.printJSON()
+	}
+	status, err := sw.QueryStatus()
+	if errors.Is(err, ErrNotInstalled) {
+		fmt.Println("not installed")
+		return nil
 	}
 	if err != nil {
-		return fmt.Errorf("failed to %s %s: %v", cmd, sw.serviceName, err)
+		return err
 	}
+	fmt.Println(StateString(status.State))
 	return nil
 }
 
-func (sw *ServiceWrapper) StartService() error {
-	m, err := mgr.Connect()
+// SetLogLevel stores level under the service Parameters registry key and
+// asks the running service to apply it through ControlSetLogLevel.
+func (sw *ServiceWrapper) SetLogLevel(level string) error {
+	if err := sw.writeLogLevel(level); err != nil {
+		return err
+	}
+	m, err := sw.connect()
 	if err != nil {
 		return err
 	}
@@ -76,34 +367,238 @@ func (sw *ServiceWrapper) StartService() error {
 		return fmt.Errorf("could not access service: %v", err)
 	}
 	defer s.Close()
-	err = s.Start("is", "manual-started")
+	if _, err := s.Control(ControlSetLogLevel); err != nil {
+		return fmt.Errorf("could not send control=%d: %v", ControlSetLogLevel, err)
+	}
+	return nil
+}
+
+func (sw *ServiceWrapper) StartService() error {
+	return sw.startService(context.Background(), sw.serviceName, false)
+}
+
+// StartServiceContext starts the service and waits until it is running,
+// returning an error if it stops instead or ctx is done first.
+func (sw *ServiceWrapper) StartServiceContext(ctx context.Context) error {
+	return sw.startService(ctx, sw.serviceName, true)
+}
+
+func (sw *ServiceWrapper) startService(ctx context.Context, name string, wait bool) error {
+	args := sw.installStartArgs
+	if args == nil {
+		args = []string{"is", "manual-started"}
+	}
+	return sw.startServiceWithArgs(ctx, name, args, wait)
+}
+
+// startServiceWithArgs starts the named service, which need not be one of
+// the wrapper, with args.
+func (sw *ServiceWrapper) startServiceWithArgs(ctx context.Context, name string, args []string, wait bool) error {
+	m, err := sw.connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("could not access service: %v", err)
+	}
+	defer s.Close()
+	err = s.Start(args...)
+	if errors.Is(err, windows.ERROR_SERVICE_CANNOT_ACCEPT_CTRL) {
+		return fmt.Errorf("could not start service: %w", ErrOperationPending)
+	}
 	if err != nil {
 		return fmt.Errorf("could not start service: %v", err)
 	}
-	return nil
+	if !wait {
+		return nil
+	}
+	status, err := s.Query()
+	if err != nil {
+		return fmt.Errorf("could not retrieve service status: %v", err)
+	}
+	return sw.waitForState(ctx, s, status, svc.Running)
 }
 
 func (sw *ServiceWrapper) ControlService(c svc.Cmd, to svc.State) error {
-	m, err := mgr.Connect()
+	return sw.ControlServiceToAny(c, to)
+}
+
+// ControlServiceToAny sends c to the service and waits until it is in any
+// of the states to, for transitions that may settle in more than one state.
+func (sw *ServiceWrapper) ControlServiceToAny(c svc.Cmd, to ...svc.State) error {
+	return sw.controlService(context.Background(), sw.serviceName, c, to)
+}
+
+// controlService sends c to the named service and waits for to until ctx is
+// done or the WaitStrategy gives up, for at most 10 seconds without one.
+func (sw *ServiceWrapper) controlService(ctx context.Context, name string, c svc.Cmd, to []svc.State) error {
+	if len(to) == 0 {
+		return fmt.Errorf("no target state given")
+	}
+	m, err := sw.connect()
 	if err != nil {
 		return err
 	}
 	defer m.Disconnect()
-	s, err := m.OpenService(sw.serviceName)
+	s, err := m.OpenService(name)
 	if err != nil {
 		return fmt.Errorf("could not access service: %v", err)
 	}
 	defer s.Close()
+	ctx, cancel := sw.controlContext(ctx)
+	defer cancel()
+	status, err := sw.sendControl(ctx, s, c)
+	if err != nil {
+		return err
+	}
+	return sw.waitForAnyState(ctx, s, status, to)
+}
+
+// sendControl sends c to s, retrying through retryControl if a pending
+// operation makes the service refuse it.
+func (sw *ServiceWrapper) sendControl(ctx context.Context, s serviceController, c svc.Cmd) (svc.Status, error) {
 	status, err := s.Control(c)
+	if errors.Is(err, windows.ERROR_SERVICE_CANNOT_ACCEPT_CTRL) {
+		return sw.retryControl(ctx, s, c)
+	}
+	if err != nil {
+		return status, fmt.Errorf("could not send control=%d: %v", c, err)
+	}
+	return status, nil
+}
+
+// StopWithDependents stops the running services depending on the service,
+// in the order the SCM lists them, then the service itself, as
+// "net stop /y" does. With restart, the dependents it stopped are started
+// again afterwards, in reverse order. Stopping stops at the first dependent
+// that fails; the errors of restarting are joined. Each stop and start waits
+// for at most 10 seconds unless a WaitStrategy is set.
+func (sw *ServiceWrapper) StopWithDependents(restart bool) error {
+	var dependents []string
+	err := sw.queryService(func(s *mgr.Service) error {
+		var err error
+		dependents, err = s.ListDependentServices(svc.Active)
+		if err != nil {
+			return fmt.Errorf("could not list dependent services: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	stop := func(name string) error {
+		return sw.controlService(context.Background(), name, svc.Stop, []svc.State{svc.Stopped})
+	}
+	start := func(name string) error {
+		ctx, cancel := sw.controlContext(context.Background())
+		defer cancel()
+		return sw.startServiceWithArgs(ctx, name, nil, true)
+	}
+	return stopWithDependents(sw.serviceName, dependents, restart, stop, start)
+}
+
+// stopWithDependents stops dependents in order, then name, through stop.
+// With restart, the dependents it stopped are started again through start,
+// last stopped first.
+func stopWithDependents(name string, dependents []string, restart bool, stop, start func(name string) error) error {
+	var stopped []string
+	for _, dependent := range dependents {
+		if err := stop(dependent); err != nil {
+			err = fmt.Errorf("when stopping dependent service %s: %w", dependent, err)
+			if restart {
+				err = errors.Join(err, startDependents(stopped, start))
+			}
+			return err
+		}
+		stopped = append(stopped, dependent)
+	}
+	err := stop(name)
+	if restart {
+		err = errors.Join(err, startDependents(stopped, start))
+	}
+	return err
+}
+
+// startDependents starts the stopped dependents again, last stopped first.
+func startDependents(stopped []string, start func(name string) error) error {
+	var errs []error
+	for i := len(stopped) - 1; i >= 0; i-- {
+		if err := start(stopped[i]); err != nil {
+			errs = append(errs, fmt.Errorf("when starting dependent service %s: %w", stopped[i], err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// retryControl sends c again once the pending operation that made the
+// service refuse it has completed. If the service is not in a pending
+// state, it returns an error wrapping ErrOperationPending straight away.
+func (sw *ServiceWrapper) retryControl(ctx context.Context, s serviceController, c svc.Cmd) (svc.Status, error) {
+	status, err := s.Query()
 	if err != nil {
-		return fmt.Errorf("could not send control=%d: %v", c, err)
+		return status, fmt.Errorf("could not retrieve service status: %v", err)
+	}
+	switch status.State {
+	case svc.StartPending, svc.StopPending, svc.ContinuePending, svc.PausePending:
+	default:
+		return status, fmt.Errorf("could not send control=%d: %w", c, ErrOperationPending)
 	}
-	timeout := time.Now().Add(10 * time.Second)
-	for status.State != to {
-		if timeout.Before(time.Now()) {
-			return fmt.Errorf("timeout waiting for service to go to state=%d", to)
+	if err := sw.waitForAnyState(ctx, s, status, []svc.State{svc.Running, svc.Stopped, svc.Paused}); err != nil {
+		return status, fmt.Errorf("could not send control=%d: %w: %v", c, ErrOperationPending, err)
+	}
+	status, err = s.Control(c)
+	if errors.Is(err, windows.ERROR_SERVICE_CANNOT_ACCEPT_CTRL) {
+		return status, fmt.Errorf("could not send control=%d: %w", c, ErrOperationPending)
+	}
+	if err != nil {
+		return status, fmt.Errorf("could not send control=%d: %v", c, err)
+	}
+	return status, nil
+}
+
+// statusQuerier is the part of mgr.Service the waits poll.
+type statusQuerier interface {
+	Query() (svc.Status, error)
+}
+
+// serviceController is the part of mgr.Service sendControl uses.
+type serviceController interface {
+	statusQuerier
+	Control(c svc.Cmd) (svc.Status, error)
+}
+
+// waitForState polls s until it reaches state to, starting from status.
+// Waiting for Running fails early if the service stops, which means it
+// crashed or refused to start.
+func (sw *ServiceWrapper) waitForState(ctx context.Context, s statusQuerier, status svc.Status, to svc.State) error {
+	return sw.waitForAnyState(ctx, s, status, []svc.State{to})
+}
+
+// waitForAnyState is waitForState for a set of acceptable states.
+func (sw *ServiceWrapper) waitForAnyState(ctx context.Context, s statusQuerier, status svc.Status, to []svc.State) error {
+	var err error
+	strategy := sw.waitStrategyOrDefault()
+	start := time.Now()
+	for !hasState(to, status.State) {
+		if hasState(to, svc.Running) && status.State == svc.Stopped {
+			return fmt.Errorf("service stopped with exit code %d", serviceExitCode(status))
+		}
+		sleep, giveUp := strategy.Next(status, time.Since(start))
+		if giveUp {
+			return fmt.Errorf("timeout waiting for service to go to state %s", statesString(to))
+		}
+		timer := time.NewTimer(sleep)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("timeout waiting for service to go to state %s", statesString(to))
+			}
+			return fmt.Errorf("stopped waiting for service to go to state %s: %w", statesString(to), ctx.Err())
+		case <-timer.C:
 		}
-		time.Sleep(300 * time.Millisecond)
 		status, err = s.Query()
 		if err != nil {
 			return fmt.Errorf("could not retrieve service status: %v", err)
@@ -111,3 +606,39 @@ func (sw *ServiceWrapper) ControlService(c svc.Cmd, to svc.State) error {
 	}
 	return nil
 }
+
+func hasState(states []svc.State, state svc.State) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// statesString returns the names of states, e.g. "Running or Paused".
+func statesString(states []svc.State) string {
+	names := make([]string, len(states))
+	for i, state := range states {
+		names[i] = StateString(state)
+	}
+	return strings.Join(names, " or ")
+}
+
+// serviceExitCode returns the exit code a stopped service reported.
+func serviceExitCode(status svc.Status) uint32 {
+	if status.Win32ExitCode == uint32(windows.ERROR_SERVICE_SPECIFIC_ERROR) {
+		return status.ServiceSpecificExitCode
+	}
+	return status.Win32ExitCode
+}
+
+// jitter spreads d by up to 20% in either direction, so that many
+// concurrent pollers don't hit the SCM in lockstep.
+func jitter(d time.Duration) time.Duration {
+	spread := int64(d) / 5
+	if spread <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(2*spread+1)-spread)
+}
@@ -0,0 +1,375 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+)
+
+func TestJitter(t *testing.T) {
+	const d = 300 * time.Millisecond
+	min, max := d-d/5, d+d/5
+	spread := false
+	for i := 0; i < 1000; i++ {
+		got := jitter(d)
+		if got < min || got > max {
+			t.Fatalf("jitter(%s) = %s, want within [%s, %s]", d, got, min, max)
+		}
+		if got != d {
+			spread = true
+		}
+	}
+	if !spread {
+		t.Errorf("jitter(%s) never changed the duration", d)
+	}
+	if got := jitter(0); got != 0 {
+		t.Errorf("jitter(0) = %s, want 0", got)
+	}
+	if got := jitter(4); got != 4 {
+		t.Errorf("jitter(4ns) = %s, want it unchanged", got)
+	}
+}
+
+func TestControlPollIntervalGrows(t *testing.T) {
+	const initial, max = 100 * time.Millisecond, time.Second
+	sw := newTestWrapper(t, idle, WithControlPollInterval(initial, max))
+	strategy := sw.waitStrategyOrDefault()
+	status := svc.Status{State: svc.StopPending}
+	var elapsed, previous time.Duration
+	for i := 0; i < 10; i++ {
+		sleep, giveUp := strategy.Next(status, elapsed)
+		if giveUp {
+			t.Fatalf("wait %d: the default strategy gave up after %s", i, elapsed)
+		}
+		want := elapsed + initial
+		if want > max {
+			want = max
+		}
+		if sleep < want-want/5 || sleep > want+want/5 {
+			t.Fatalf("wait %d after %s: slept %s, want about %s", i, elapsed, sleep, want)
+		}
+		if want < max && want <= previous {
+			t.Fatalf("wait %d: interval %s did not grow from %s", i, want, previous)
+		}
+		previous = want
+		elapsed += sleep
+	}
+	if previous != max {
+		t.Errorf("interval ended at %s, want the cap %s", previous, max)
+	}
+}
+
+func TestCommandsHaveHandlers(t *testing.T) {
+	for _, cmd := range Commands() {
+		if cmd.Name == "debug" {
+			continue // run by ManageService itself
+		}
+		if commandHandler(cmd.Name) == nil {
+			t.Errorf("command %s is listed but has no handler", cmd.Name)
+		}
+		if cmd.Description == "" {
+			t.Errorf("command %s has no description", cmd.Name)
+		}
+	}
+	if commandHandler("nonsense") != nil {
+		t.Error("an unknown command has a handler")
+	}
+}
+
+func TestCommandList(t *testing.T) {
+	list := commandList()
+	for _, cmd := range Commands() {
+		if !strings.Contains(list, " "+cmd.Name) {
+			t.Errorf("the usage text does not list %s:\n%s", cmd.Name, list)
+		}
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(list, "\n"), "\n") {
+		if !strings.HasPrefix(line, "       ") || len(line) > 72 {
+			t.Errorf("usage line %q is not indented and wrapped", line)
+		}
+	}
+	if !strings.HasSuffix(list, "selftest.\n") {
+		t.Errorf("the usage text does not end the list with a full stop:\n%s", list)
+	}
+}
+
+func TestCommandAliasesResolve(t *testing.T) {
+	sw := newTestWrapper(t, idle, WithCommandAliases(map[string]string{"Uninstall": "remove", "run": "debug"}))
+	if got := sw.resolveCommand("UNINSTALL"); got != "remove" || commandHandler(got) == nil {
+		t.Errorf(`resolveCommand("UNINSTALL") = %q, want the remove command`, got)
+	}
+	if got := sw.resolveCommand("run"); got != "debug" {
+		t.Errorf(`resolveCommand("run") = %q, want debug`, got)
+	}
+	if _, err := GetServiceWrapper(idle, "svchelper-test", "svchelper test", "", false, WithCommandAliases(map[string]string{"stop": "remove"})); err == nil {
+		t.Error("an alias shadowing a built-in command was accepted")
+	}
+}
+
+// fakeSCM runs a dependency graph of services, refusing to stop a service
+// another running one depends on and starting the dependencies of a
+// service first, as the SCM does.
+type fakeSCM struct {
+	dependsOn map[string][]string
+	running   map[string]bool
+	fail      string
+	calls     []string
+}
+
+func newFakeSCM() *fakeSCM {
+	// web depends on api, which depends on db; metrics depends on db.
+	return &fakeSCM{
+		dependsOn: map[string][]string{"web": {"api"}, "api": {"db"}, "metrics": {"db"}},
+		running:   map[string]bool{"db": true, "api": true, "web": true, "metrics": true},
+	}
+}
+
+func (f *fakeSCM) stop(name string) error {
+	f.calls = append(f.calls, "stop "+name)
+	if name == f.fail {
+		return errors.New("refused")
+	}
+	for service, deps := range f.dependsOn {
+		for _, dep := range deps {
+			if dep == name && f.running[service] {
+				return fmt.Errorf("%s depends on %s", service, name)
+			}
+		}
+	}
+	f.running[name] = false
+	return nil
+}
+
+func (f *fakeSCM) start(name string) error {
+	f.calls = append(f.calls, "start "+name)
+	f.startWithDependencies(name)
+	return nil
+}
+
+func (f *fakeSCM) startWithDependencies(name string) {
+	for _, dep := range f.dependsOn[name] {
+		f.startWithDependencies(dep)
+	}
+	f.running[name] = true
+}
+
+func TestStopWithDependents(t *testing.T) {
+	// The SCM lists the dependents of db with the outermost first.
+	dependents := []string{"web", "metrics", "api"}
+	tests := []struct {
+		desc      string
+		restart   bool
+		fail      string
+		wantErr   string
+		wantCalls []string
+		running   []string
+	}{
+		{desc: "stop", wantCalls: []string{"stop web", "stop metrics", "stop api", "stop db"}},
+		{desc: "restart", restart: true,
+			wantCalls: []string{"stop web", "stop metrics", "stop api", "stop db", "start api", "start metrics", "start web"}, running: []string{"db", "api", "web", "metrics"}},
+		{desc: "dependent fails", fail: "metrics", wantErr: "dependent service metrics",
+			wantCalls: []string{"stop web", "stop metrics"}, running: []string{"db", "api", "metrics"}},
+		{desc: "dependent fails with restart", restart: true, fail: "api", wantErr: "dependent service api",
+			wantCalls: []string{"stop web", "stop metrics", "stop api", "start metrics", "start web"}, running: []string{"db", "api", "web", "metrics"}},
+		{desc: "service fails with restart", restart: true, fail: "db", wantErr: "refused",
+			wantCalls: []string{"stop web", "stop metrics", "stop api", "stop db", "start api", "start metrics", "start web"}, running: []string{"db", "api", "web", "metrics"}},
+	}
+	for _, tt := range tests {
+		scm := newFakeSCM()
+		scm.fail = tt.fail
+		err := stopWithDependents("db", dependents, tt.restart, scm.stop, scm.start)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: stopWithDependents failed: %v", tt.desc, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: stopWithDependents returned %v, want an error mentioning %q", tt.desc, err, tt.wantErr)
+		}
+		if fmt.Sprint(scm.calls) != fmt.Sprint(tt.wantCalls) {
+			t.Errorf("%s: calls %v, want %v", tt.desc, scm.calls, tt.wantCalls)
+		}
+		want := map[string]bool{}
+		for _, name := range tt.running {
+			want[name] = true
+		}
+		for name, running := range scm.running {
+			if running != want[name] {
+				t.Errorf("%s: %s running = %t, want %t", tt.desc, name, running, want[name])
+			}
+		}
+	}
+}
+
+// scriptedService is a statusQuerier whose Query returns statuses in turn,
+// repeating the last one.
+type scriptedService struct {
+	mu       sync.Mutex
+	statuses []svc.Status
+	queries  int
+}
+
+func (s *scriptedService) Query() (svc.Status, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.queries
+	if i >= len(s.statuses) {
+		i = len(s.statuses) - 1
+	}
+	s.queries++
+	return s.statuses[i], nil
+}
+
+func TestWaitForState(t *testing.T) {
+	sw := newTestWrapper(t, idle, WithControlPollInterval(5*time.Millisecond, 5*time.Millisecond))
+	pending := svc.Status{State: svc.StartPending}
+
+	starting := &scriptedService{statuses: []svc.Status{pending, pending, {State: svc.Running}}}
+	if err := sw.waitForState(context.Background(), starting, pending, svc.Running); err != nil {
+		t.Errorf("waiting for a service that starts failed: %v", err)
+	}
+
+	crashed := svc.Status{State: svc.Stopped, Win32ExitCode: uint32(windows.ERROR_SERVICE_SPECIFIC_ERROR), ServiceSpecificExitCode: 3}
+	crashing := &scriptedService{statuses: []svc.Status{pending, crashed}}
+	if err := sw.waitForState(context.Background(), crashing, pending, svc.Running); err == nil || !strings.Contains(err.Error(), "exit code 3") {
+		t.Errorf("waiting for a service that crashes returned %v, want its exit code", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	hanging := &scriptedService{statuses: []svc.Status{pending}}
+	if err := sw.waitForState(ctx, hanging, pending, svc.Running); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("waiting past the deadline returned %v, want a timeout", err)
+	}
+}
+
+func TestWaitForStateCancelled(t *testing.T) {
+	sw := newTestWrapper(t, idle, WithControlPollInterval(5*time.Millisecond, 5*time.Millisecond))
+	pending := svc.Status{State: svc.StartPending}
+	s := &scriptedService{statuses: []svc.Status{pending}}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	begin := time.Now()
+	err := sw.waitForState(ctx, s, pending, svc.Running)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("waitForState returned %v, want context.Canceled", err)
+	}
+	if took := time.Since(begin); took > 2*time.Second {
+		t.Errorf("waitForState took %s to notice the cancellation", took)
+	}
+	if s.queries == 0 {
+		t.Error("waitForState never polled the service")
+	}
+}
+
+// refusingService is a scriptedService whose Control fails with
+// ERROR_SERVICE_CANNOT_ACCEPT_CTRL for the first refusals controls and
+// then accepts them.
+type refusingService struct {
+	scriptedService
+	refusals int
+	controls []svc.Cmd
+}
+
+func (s *refusingService) Control(c svc.Cmd) (svc.Status, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.controls = append(s.controls, c)
+	if len(s.controls) <= s.refusals {
+		return svc.Status{}, windows.ERROR_SERVICE_CANNOT_ACCEPT_CTRL
+	}
+	return svc.Status{State: svc.StopPending}, nil
+}
+
+func TestSendControlPending(t *testing.T) {
+	sw := newTestWrapper(t, idle, WithControlPollInterval(5*time.Millisecond, 5*time.Millisecond))
+	running := svc.Status{State: svc.Running}
+	pending := svc.Status{State: svc.StartPending}
+	tests := []struct {
+		desc         string
+		statuses     []svc.Status
+		refusals     int
+		wantPending  bool
+		wantControls int
+	}{
+		{desc: "accepted", statuses: []svc.Status{running}, wantControls: 1},
+		{desc: "refused while not pending", statuses: []svc.Status{running}, refusals: 1, wantPending: true, wantControls: 1},
+		{desc: "refused until the start settles", statuses: []svc.Status{pending, pending, running}, refusals: 1, wantControls: 2},
+		{desc: "refused again after the start", statuses: []svc.Status{pending, running}, refusals: 2, wantPending: true, wantControls: 2},
+	}
+	for _, tt := range tests {
+		s := &refusingService{scriptedService: scriptedService{statuses: tt.statuses}, refusals: tt.refusals}
+		status, err := sw.sendControl(context.Background(), s, svc.Stop)
+		if tt.wantPending {
+			if !errors.Is(err, ErrOperationPending) {
+				t.Errorf("%s: sendControl returned %v, want ErrOperationPending", tt.desc, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: sendControl failed: %v", tt.desc, err)
+		} else if status.State != svc.StopPending {
+			t.Errorf("%s: sendControl returned state %d, want StopPending", tt.desc, status.State)
+		}
+		if len(s.controls) != tt.wantControls {
+			t.Errorf("%s: sent %d controls, want %d", tt.desc, len(s.controls), tt.wantControls)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	s := &refusingService{scriptedService: scriptedService{statuses: []svc.Status{pending}}, refusals: 1}
+	if _, err := sw.sendControl(ctx, s, svc.Stop); !errors.Is(err, ErrOperationPending) {
+		t.Errorf("sendControl to a service stuck pending returned %v, want ErrOperationPending", err)
+	}
+}
+
+func TestUsageText(t *testing.T) {
+	sw := newTestWrapper(t, idle)
+	var b strings.Builder
+	sw.writeUsage(&b, "no command specified")
+	// The text the usage printed before it was rendered from Commands.
+	want := "no command specified\n\n" +
+		"usage: " + os.Args[0] + " [--service-name <name>] [--json] <command> [arguments...]\n" +
+		"       where <command> is one of\n" +
+		"       install, remove, reinstall, reconfigure, enable, debug, start,\n" +
+		"       stop, pause, continue, drain, info, status, preflight,\n" +
+		"       loglevel <level>, diagnostics [file] or selftest.\n"
+	if b.String() != want {
+		t.Errorf("the usage text is\n%s\nwant\n%s", b.String(), want)
+	}
+
+	aliased := newTestWrapper(t, idle, WithCommandAliases(map[string]string{"uninstall": "remove", "run": "debug"}))
+	b.Reset()
+	aliased.writeUsage(&b, "no command specified")
+	if !strings.HasSuffix(b.String(), want[len("no command specified\n\n"):]+"       aliases: run (debug), uninstall (remove).\n") {
+		t.Errorf("the usage text with aliases is\n%s", b.String())
+	}
+}
+
+func TestManageServiceUsage(t *testing.T) {
+	sw := newTestWrapper(t, idle)
+	for _, args := range [][]string{
+		{},
+		{"--service-name"},
+		{"bogus"},
+		{"loglevel"},
+	} {
+		// A usage error used to exit the process, which would end the test.
+		err := manage(sw, args...)
+		if !errors.Is(err, ErrUsage) {
+			t.Errorf("ManageService(%q) returned %v, want ErrUsage", args, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// Manifest is the declarative description of a service read by
+// GetServiceWrapperFromManifest, typically shipped as service.json next to
+// the binary.
+type Manifest struct {
+	Name                         string   `json:"name"`
+	DisplayName                  string   `json:"display_name"`
+	Description                  string   `json:"description"`
+	StartType                    string   `json:"start_type"` // automatic (default), manual or disabled
+	Dependencies                 []string `json:"dependencies"`
+	Account                      string   `json:"account"`
+	Password                     string   `json:"password"`
+	UseExePathAsWorkingDirectory bool     `json:"use_exe_path_as_working_directory"`
+}
+
+// LoadManifest reads and validates a JSON manifest. Unknown fields are
+// rejected so that typos don't go unnoticed. A relative path is resolved
+// against the directory of the executable, as the SCM starts services in the
+// system directory.
+func LoadManifest(path string) (*Manifest, error) {
+	path, err := resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("when reading the manifest: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	manifest := &Manifest{}
+	if err := decoder.Decode(manifest); err != nil {
+		return nil, fmt.Errorf("when parsing the manifest %s: %w", path, err)
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("when parsing the manifest %s: unexpected data after the manifest object", path)
+	}
+	if manifest.Name == "" {
+		return nil, fmt.Errorf("manifest %s: missing required field name", path)
+	}
+	if manifest.Password != "" && manifest.Account == "" {
+		return nil, fmt.Errorf("manifest %s: password given without account", path)
+	}
+	if _, err := parseStartType(manifest.StartType); err != nil {
+		return nil, fmt.Errorf("manifest %s: %w", path, err)
+	}
+	return manifest, nil
+}
+
+// Options returns the options expressing the manifest settings.
+func (manifest *Manifest) Options() []Option {
+	startType, _ := parseStartType(manifest.StartType)
+	opts := []Option{WithStartType(startType)}
+	if len(manifest.Dependencies) > 0 {
+		opts = append(opts, WithDependencies(manifest.Dependencies...))
+	}
+	if manifest.Account != "" {
+		opts = append(opts, WithServiceAccount(manifest.Account, manifest.Password))
+	}
+	return opts
+}
+
+// GetServiceWrapperFromManifest creates a ServiceWrapper from the manifest at
+// path. Any opts are applied after the manifest settings.
+func GetServiceWrapperFromManifest(service Service, path string, opts ...Option) (*ServiceWrapper, error) {
+	manifest, err := LoadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	displayName := manifest.DisplayName
+	if displayName == "" {
+		displayName = manifest.Name
+	}
+	return GetServiceWrapper(service, manifest.Name, displayName, manifest.Description, manifest.UseExePathAsWorkingDirectory, append(manifest.Options(), opts...)...)
+}
+
+func parseStartType(startType string) (uint32, error) {
+	switch strings.ToLower(startType) {
+	case "", "automatic", "auto":
+		return mgr.StartAutomatic, nil
+	case "manual":
+		return mgr.StartManual, nil
+	case "disabled":
+		return mgr.StartDisabled, nil
+	}
+	return 0, fmt.Errorf("invalid start type %q, expected automatic, manual or disabled", startType)
+}
@@ -0,0 +1,34 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+// acquireInstanceMutex creates the named mutex guarding against a second
+// instance of the service. Only the existence of the mutex matters, so it is
+// never locked; it is held until the returned handle is closed.
+func acquireInstanceMutex(name string) (windows.Handle, error) {
+	p, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return 0, err
+	}
+	h, err := windows.CreateMutex(nil, false, p)
+	if errors.Is(err, windows.ERROR_ALREADY_EXISTS) {
+		windows.CloseHandle(h)
+		return 0, fmt.Errorf("mutex %s: %w", name, ErrAlreadyRunning)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not create mutex %s: %v", name, err)
+	}
+	return h, nil
+}
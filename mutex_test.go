@@ -0,0 +1,77 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+func TestSingleInstanceMutex(t *testing.T) {
+	mutex := `Local\svchelper-test-` + t.Name()
+	// The first instance runs until release is closed, as
+	// WithExitWhenScheduleReturns ends the run once Schedule returns.
+	entered, release := make(chan struct{}), make(chan struct{})
+	holding := scheduleFunc(func(ctx context.Context, wg *sync.WaitGroup, cancel context.CancelFunc) error {
+		close(entered)
+		<-release
+		return nil
+	})
+	first := newTestWrapper(t, holding, WithSingleInstanceMutex(mutex), WithExitWhenScheduleReturns())
+	second := newTestWrapper(t, idle, WithSingleInstanceMutex(mutex), WithExitWhenScheduleReturns())
+
+	firstDone := make(chan error, 1)
+	go func() { firstDone <- first.RunService(true) }()
+	select {
+	case <-entered:
+	case err := <-firstDone:
+		t.Fatalf("the first instance ended early: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first instance did not start")
+	}
+	secondDone := make(chan error, 1)
+	go func() { secondDone <- second.RunService(true) }()
+	select {
+	case err := <-secondDone:
+		if !errors.Is(err, ErrAlreadyRunning) {
+			t.Errorf("the second instance returned %v, want ErrAlreadyRunning", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the second instance ran alongside the first")
+	}
+	close(release)
+	if err := <-firstDone; err != nil {
+		t.Errorf("the first instance failed: %v", err)
+	}
+	// The mutex is released with the first run.
+	if err := second.RunService(true); err != nil {
+		t.Errorf("the second instance failed after the first ended: %v", err)
+	}
+}
+
+func TestAcquireInstanceMutex(t *testing.T) {
+	name := `Local\svchelper-test-` + t.Name()
+	h, err := acquireInstanceMutex(name)
+	if err != nil {
+		t.Fatalf("acquireInstanceMutex failed: %v", err)
+	}
+	if _, err := acquireInstanceMutex(name); !errors.Is(err, ErrAlreadyRunning) {
+		t.Errorf("acquiring a held mutex returned %v, want ErrAlreadyRunning", err)
+	}
+	windows.CloseHandle(h)
+	h, err = acquireInstanceMutex(name)
+	if err != nil {
+		t.Fatalf("acquiring a released mutex failed: %v", err)
+	}
+	windows.CloseHandle(h)
+}
@@ -0,0 +1,975 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// Option customizes a ServiceWrapper created by GetServiceWrapper.
+type Option func(sw *ServiceWrapper) error
+
+const (
+	defaultReadyTimeout    = 30 * time.Second
+	defaultPollInterval    = 300 * time.Millisecond
+	defaultMaxPollInterval = 2 * time.Second
+	defaultMaxRestarts     = 3
+	defaultRestartDelay    = 5 * time.Second
+)
+
+// WithReadyTimeout bounds how long Execute waits for a Readier service
+// to signal readiness before giving up on the start.
+func WithReadyTimeout(timeout time.Duration) Option {
+	return func(sw *ServiceWrapper) error {
+		if timeout <= 0 {
+			return fmt.Errorf("ready timeout must be positive, got %s", timeout)
+		}
+		sw.readyTimeout = timeout
+		return nil
+	}
+}
+
+// WithServiceNameFromEnv overrides the service name with the value of the
+// given environment variable when it is set, so one binary can be installed
+// as several named instances. A --service-name argument takes precedence.
+func WithServiceNameFromEnv(envVar string) Option {
+	return func(sw *ServiceWrapper) error {
+		if name := os.Getenv(envVar); name != "" {
+			return sw.setServiceName(name)
+		}
+		return nil
+	}
+}
+
+// WithRegistryValues writes additional values directly under the service
+// registry key during InstallService. Values must be string (REG_SZ), uint32
+// (REG_DWORD), uint64 (REG_QWORD) or []byte (REG_BINARY).
+func WithRegistryValues(values map[string]any) Option {
+	return func(sw *ServiceWrapper) error {
+		if err := validateRegistryValues(values); err != nil {
+			return err
+		}
+		if sw.registryValues == nil {
+			sw.registryValues = make(map[string]any, len(values))
+		}
+		for name, value := range values {
+			sw.registryValues[name] = value
+		}
+		return nil
+	}
+}
+
+// WithEventLogTimeout bounds how long RunService waits for the event log to
+// open or close. When opening times out the service runs without event logging.
+func WithEventLogTimeout(timeout time.Duration) Option {
+	return func(sw *ServiceWrapper) error {
+		if timeout <= 0 {
+			return fmt.Errorf("eventlog timeout must be positive, got %s", timeout)
+		}
+		sw.eventLogTimeout = timeout
+		return nil
+	}
+}
+
+// WithServiceAccount installs the service to run as the given account instead
+// of LocalSystem. The password is ignored for accounts that do not have one.
+func WithServiceAccount(account, password string) Option {
+	return func(sw *ServiceWrapper) error {
+		if account == "" {
+			return fmt.Errorf("service account must not be empty")
+		}
+		sw.serviceAccount = account
+		sw.servicePassword = password
+		return nil
+	}
+}
+
+// WithVirtualServiceAccount installs the service to run as its virtual
+// account, NT SERVICE\<service name>, which needs no password and holds the
+// logon right. Unless WithServiceSidType says otherwise the service SID type
+// is unrestricted, so the account is the service SID: resources are granted
+// to it by that name, e.g. with
+// "icacls <dir> /grant "NT SERVICE\<service name>":(OI)(CI)M", or by the
+// SID from "sc showsid <service name>". The account follows a service name
+// overridden on the command line.
+func WithVirtualServiceAccount() Option {
+	return func(sw *ServiceWrapper) error {
+		sw.serviceAccount = virtualAccountPrefix + sw.serviceName
+		sw.servicePassword = ""
+		sw.virtualAccount = true
+		return nil
+	}
+}
+
+// WithServiceAccountPasswordEnv reads the password of the account set by
+// WithServiceAccount from the environment variable name at install and
+// reconfigure time, keeping it out of the command line and the code.
+func WithServiceAccountPasswordEnv(name string) Option {
+	return func(sw *ServiceWrapper) error {
+		if name == "" {
+			return fmt.Errorf("password variable name must not be empty")
+		}
+		sw.passwordSource = func() ([]byte, error) {
+			return passwordFromEnv(name)
+		}
+		return nil
+	}
+}
+
+// WithServiceAccountPasswordPrompt asks for the password of the account set
+// by WithServiceAccount on the console, without echo, at install and
+// reconfigure time.
+func WithServiceAccountPasswordPrompt() Option {
+	return func(sw *ServiceWrapper) error {
+		sw.passwordSource = func() ([]byte, error) {
+			return promptPassword(fmt.Sprintf("Password for %s: ", sw.serviceAccount))
+		}
+		return nil
+	}
+}
+
+// WithGrantLogonRight makes InstallService grant "Log on as a service"
+// (SeServiceLogonRight) to the account set by WithServiceAccount, without
+// which the service fails to start.
+func WithGrantLogonRight() Option {
+	return func(sw *ServiceWrapper) error {
+		sw.grantLogonRight = true
+		return nil
+	}
+}
+
+// WithServiceType sets the service type the service is installed with,
+// windows.SERVICE_WIN32_OWN_PROCESS by default.
+//
+// windows.SERVICE_WIN32_SHARE_PROCESS is not supported: running several
+// services in one process needs a dispatch table with an entry per
+// service, while the x/sys svc dispatcher used by RunService registers a
+// single service and reports it as an own-process service.
+//
+// windows.SERVICE_KERNEL_DRIVER and SERVICE_FILE_SYSTEM_DRIVER install a
+// companion driver from the file set by WithDriverPath. Only the install,
+// remove, start, stop and query commands apply to drivers: they have no
+// event source, run under no account, and cannot be interactive, accept
+// preshutdown notifications or grant a logon right.
+func WithServiceType(serviceType uint32) Option {
+	return func(sw *ServiceWrapper) error {
+		switch serviceType {
+		case windows.SERVICE_WIN32_OWN_PROCESS, windows.SERVICE_KERNEL_DRIVER, windows.SERVICE_FILE_SYSTEM_DRIVER:
+		default:
+			return fmt.Errorf("unsupported service type %#x", serviceType)
+		}
+		sw.serviceType = serviceType
+		return nil
+	}
+}
+
+// WithExePathResolver replaces the logic ExePath uses to find the binary
+// the service is installed with, e.g. for a launcher stub starting the real
+// binary. The path returned by resolver must name an existing file.
+func WithExePathResolver(resolver func() (string, error)) Option {
+	return func(sw *ServiceWrapper) error {
+		if resolver == nil {
+			return fmt.Errorf("exe path resolver must not be nil")
+		}
+		sw.exePathResolver = resolver
+		return nil
+	}
+}
+
+// WithDriverPath sets the driver file, e.g. a .sys file, a driver service
+// type is installed from in place of the executable.
+func WithDriverPath(path string) Option {
+	return func(sw *ServiceWrapper) error {
+		if path == "" {
+			return fmt.Errorf("driver path must not be empty")
+		}
+		p, err := filepath.Abs(path)
+		if err != nil {
+			return fmt.Errorf("when resolving the driver path: %w", err)
+		}
+		sw.driverPath = p
+		return nil
+	}
+}
+
+// WithEventMessageFile registers the event source with the message file at
+// path, e.g. a DLL with localized message resources, in place of the
+// EventCreate.exe of the system. A relative path is resolved with
+// ResolvePath; the file must exist and be readable when the source is
+// registered. The event IDs passed to the log must then match the message
+// table of the file.
+func WithEventMessageFile(path string) Option {
+	return func(sw *ServiceWrapper) error {
+		if path == "" {
+			return fmt.Errorf("event message file path must not be empty")
+		}
+		sw.eventMessageFile = path
+		return nil
+	}
+}
+
+// maxDescriptionLength is the longest description accepted from a file or
+// reader.
+const maxDescriptionLength = 2048
+
+// WithDescriptionFromFile reads the service description from the file at
+// path when the service is installed or reconfigured, in place of the
+// description passed to GetServiceWrapper. A relative path is resolved with
+// ResolvePath.
+func WithDescriptionFromFile(path string) Option {
+	return func(sw *ServiceWrapper) error {
+		if path == "" {
+			return fmt.Errorf("description file path must not be empty")
+		}
+		sw.descriptionSource = func() (string, error) {
+			data, err := os.ReadFile(ResolvePath(path))
+			if err != nil {
+				return "", fmt.Errorf("when reading the description file: %w", err)
+			}
+			return string(data), nil
+		}
+		return nil
+	}
+}
+
+// WithDescriptionReader is WithDescriptionFromFile for a reader, e.g. a
+// file of an embedded FS. The reader is read once, on first use.
+func WithDescriptionReader(r io.Reader) Option {
+	return func(sw *ServiceWrapper) error {
+		var once sync.Once
+		var description string
+		var err error
+		sw.descriptionSource = func() (string, error) {
+			once.Do(func() {
+				var data []byte
+				if data, err = io.ReadAll(r); err != nil {
+					err = fmt.Errorf("when reading the description: %w", err)
+				}
+				description = string(data)
+			})
+			return description, err
+		}
+		return nil
+	}
+}
+
+// WithStartArgs sets the arguments the service is started with. They are
+// stored at install, see StartArgs, and passed by StartService.
+func WithStartArgs(args ...string) Option {
+	return func(sw *ServiceWrapper) error {
+		if len(args) == 0 {
+			return fmt.Errorf("at least one start argument is required")
+		}
+		sw.installStartArgs = args
+		return nil
+	}
+}
+
+// WithInteractive sets the legacy "Allow service to interact with desktop"
+// flag. It is deprecated by Windows, only has an effect for services running
+// as LocalSystem and cannot be combined with WithServiceAccount.
+func WithInteractive() Option {
+	return func(sw *ServiceWrapper) error {
+		sw.interactive = true
+		return nil
+	}
+}
+
+const maxServiceNameLength = 256
+
+// normalizeServiceName trims surrounding whitespace from name and checks it
+// against the constraints the SCM puts on service names.
+func normalizeServiceName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	switch {
+	case name == "":
+		return "", fmt.Errorf("service name must not be empty")
+	case len(utf16.Encode([]rune(name))) > maxServiceNameLength:
+		return "", fmt.Errorf("service name %.32q... exceeds %d characters", name, maxServiceNameLength)
+	case strings.ContainsAny(name, `/\`):
+		return "", fmt.Errorf("service name %q must not contain slashes", name)
+	}
+	for _, r := range name {
+		if r < ' ' {
+			return "", fmt.Errorf("service name %q must not contain control characters", name)
+		}
+	}
+	return name, nil
+}
+
+// WithETWProvider additionally writes the messages of the wrapper as ETW
+// events of the provider with the given GUID, for capturing them with wpr
+// or tracelog. When the provider cannot be registered, a warning is logged
+// and the service runs with the event log only.
+func WithETWProvider(provider windows.GUID) Option {
+	return func(sw *ServiceWrapper) error {
+		sw.etwProvider = &provider
+		return nil
+	}
+}
+
+// WithSingleInstanceMutex makes RunService fail with ErrAlreadyRunning while
+// another process holds the named mutex, e.g. when the binary is started by
+// hand next to the instance run by the SCM. Prefix the name with "Global\"
+// to guard across sessions.
+func WithSingleInstanceMutex(name string) Option {
+	return func(sw *ServiceWrapper) error {
+		if name == "" {
+			return fmt.Errorf("mutex name must not be empty")
+		}
+		sw.instanceMutex = name
+		return nil
+	}
+}
+
+// WithoutEventSourceRegistration keeps InstallService and RemoveService from
+// touching the event log source, for installers that manage it separately
+// through RegisterEventSource and UnregisterEventSource.
+func WithoutEventSourceRegistration() Option {
+	return func(sw *ServiceWrapper) error {
+		sw.skipEventSource = true
+		return nil
+	}
+}
+
+// WithExitWhenScheduleReturns makes a nil return from Schedule stop the
+// service cleanly, for services doing all their work synchronously in
+// Schedule. By default the service keeps running until it is stopped by the
+// SCM or cancels itself.
+func WithExitWhenScheduleReturns() Option {
+	return func(sw *ServiceWrapper) error {
+		sw.exitWhenScheduleReturns = true
+		return nil
+	}
+}
+
+// WithRemoteHost makes InstallService, RemoveService, StartService and
+// ControlService operate on the SCM of the given host instead of the local
+// one. The calling user needs administrative rights on the remote host, and
+// the Remote Registry service must be running there for WithRegistryValues.
+// The executable path is registered as resolved locally, so the binary must
+// exist at the same path on the remote host. Event log sources are local to
+// each machine and are not registered remotely.
+func WithRemoteHost(host string) Option {
+	return func(sw *ServiceWrapper) error {
+		if host == "" {
+			return fmt.Errorf("remote host must not be empty")
+		}
+		sw.remoteHost = host
+		return nil
+	}
+}
+
+// WithControlPollInterval sets how ControlService polls for the target state:
+// it starts waiting initial between queries and doubles the wait, up to max,
+// while the transition drags on.
+func WithControlPollInterval(initial, max time.Duration) Option {
+	return func(sw *ServiceWrapper) error {
+		if initial <= 0 || max < initial {
+			return fmt.Errorf("invalid poll interval %s with cap %s", initial, max)
+		}
+		sw.pollInterval = initial
+		sw.maxPollInterval = max
+		return nil
+	}
+}
+
+// WithPowerPolicy sets on which power source the service runs. With
+// PowerPolicyACOnly a service started on battery stops again right away,
+// and a running one stops, cleanly so no recovery action applies, when the
+// machine switches to battery.
+//
+// The policy only applies at run time, through the power events the
+// service accepts, so it needs no particular Windows version. It installs
+// no trigger: the SCM has none for the return of AC power, so starting the
+// service again is left to something else, e.g. a scheduled task running
+// "start" with the "Start only if the computer is on AC power" condition.
+func WithPowerPolicy(policy PowerPolicy) Option {
+	return func(sw *ServiceWrapper) error {
+		switch policy {
+		case PowerPolicyAny, PowerPolicyACOnly:
+		default:
+			return fmt.Errorf("unknown power policy %d", policy)
+		}
+		sw.powerPolicy = policy
+		return nil
+	}
+}
+
+// WithWaitStrategy replaces how ControlService and the management commands
+// wait for the target state, see WaitStrategy. The strategy takes over the
+// 10 second limit of the controls; they still end when their context is
+// done.
+func WithWaitStrategy(strategy WaitStrategy) Option {
+	return func(sw *ServiceWrapper) error {
+		if strategy == nil {
+			return fmt.Errorf("wait strategy must not be nil")
+		}
+		sw.waitStrategy = strategy
+		return nil
+	}
+}
+
+// WithStartType sets the start type the service is installed with, one of
+// mgr.StartAutomatic (the default), mgr.StartManual or mgr.StartDisabled.
+//
+// The early start types windows.SERVICE_BOOT_START, for drivers loaded by
+// the boot loader, and SERVICE_SYSTEM_START, for drivers loaded during
+// kernel initialization, are only valid with a driver service type set by
+// WithServiceType; the SCM rejects them for Win32 services.
+func WithStartType(startType uint32) Option {
+	return func(sw *ServiceWrapper) error {
+		switch startType {
+		case mgr.StartAutomatic, mgr.StartManual, mgr.StartDisabled,
+			windows.SERVICE_BOOT_START, windows.SERVICE_SYSTEM_START:
+		default:
+			return fmt.Errorf("invalid start type %d", startType)
+		}
+		sw.startType = startType
+		return nil
+	}
+}
+
+// WithDependencies installs the service depending on the named services, so
+// the SCM starts them first.
+func WithDependencies(services ...string) Option {
+	return func(sw *ServiceWrapper) error {
+		for _, name := range services {
+			if strings.TrimSpace(name) == "" {
+				return fmt.Errorf("dependency name must not be empty")
+			}
+		}
+		sw.dependencies = append(sw.dependencies, services...)
+		return nil
+	}
+}
+
+// WithInterrogateDelay makes Execute answer an Interrogate request twice,
+// delay apart, as the upstream x/sys example does to reproduce an old
+// deadlock. By default the status is echoed once without delay.
+func WithInterrogateDelay(delay time.Duration) Option {
+	return func(sw *ServiceWrapper) error {
+		if delay < 0 {
+			return fmt.Errorf("interrogate delay must not be negative, got %s", delay)
+		}
+		sw.interrogateDelay = delay
+		return nil
+	}
+}
+
+// WithStopTimeout bounds the whole stop sequence of the service: the
+// Shutdowner call and waiting for the goroutines of the cancelled service
+// share this one deadline, after which the service is reported stopped
+// regardless. By default the sequence takes as long as it takes.
+func WithStopTimeout(timeout time.Duration) Option {
+	return func(sw *ServiceWrapper) error {
+		if timeout <= 0 {
+			return fmt.Errorf("stop timeout must be positive, got %s", timeout)
+		}
+		sw.stopTimeout = timeout
+		return nil
+	}
+}
+
+// WithGracefulStopDelay splits stopping into two phases, as Kubernetes
+// preStop hooks do: a GracefulStopper is told to begin shutting down, and
+// the context is only cancelled once the goroutines of the service have
+// returned or d has passed. The delay counts towards WithStopTimeout.
+func WithGracefulStopDelay(d time.Duration) Option {
+	return func(sw *ServiceWrapper) error {
+		if d <= 0 {
+			return fmt.Errorf("graceful stop delay must be positive, got %s", d)
+		}
+		sw.gracefulStopDelay = d
+		return nil
+	}
+}
+
+// WithManagementTimeout bounds the management commands run by
+// ManageService, such as install or stop, to d. A command still running
+// then is abandoned with a timeout error, so an unresponsive SCM cannot
+// block a deployment forever. By default there is no bound.
+func WithManagementTimeout(d time.Duration) Option {
+	return func(sw *ServiceWrapper) error {
+		if d <= 0 {
+			return fmt.Errorf("management timeout must be positive, got %s", d)
+		}
+		sw.managementTimeout = d
+		return nil
+	}
+}
+
+// WithAuditLog appends a timestamped record of every install, removal and
+// reconfiguration, with the service name, executable path and the user
+// performing it, to the file at path. The file is created if missing.
+func WithAuditLog(path string) Option {
+	return func(sw *ServiceWrapper) error {
+		if path == "" {
+			return fmt.Errorf("audit log path must not be empty")
+		}
+		sw.auditLogPath = path
+		return nil
+	}
+}
+
+// WithPreshutdownTimeout makes the service accept preshutdown notifications,
+// stopping as soon as the system starts shutting down, and installs it with
+// the given preshutdown timeout so the SCM grants it that much time. The
+// timeout is stored in milliseconds; Windows uses three minutes when it is
+// not set, and the overall shutdown may still be cut short by the system.
+func WithPreshutdownTimeout(timeout time.Duration) Option {
+	return func(sw *ServiceWrapper) error {
+		if timeout < time.Millisecond || timeout/time.Millisecond > math.MaxUint32 {
+			return fmt.Errorf("preshutdown timeout %s out of range", timeout)
+		}
+		sw.preshutdownTimeout = timeout
+		return nil
+	}
+}
+
+// WithConfigValidator sets a function vetting the service config before
+// InstallService or Reconfigure writes it, aborting them if it returns an
+// error. This lets a shared package enforce organization policies. The
+// config is the one passed to the SCM, with BinaryPathName holding the full
+// command line to be registered and Password the password given to
+// WithServiceAccount, if any. A password from WithServiceAccountPasswordEnv
+// or WithServiceAccountPasswordPrompt is only read once the validator has
+// approved the config, so the validator never sees it.
+func WithConfigValidator(validator func(mgr.Config) error) Option {
+	return func(sw *ServiceWrapper) error {
+		sw.configValidator = validator
+		return nil
+	}
+}
+
+// WithStatusObserver calls observer with every status Execute reports to
+// the SCM, synchronously and before it is sent. It is meant for tests
+// asserting the StartPending, Running and StopPending sequence of a service:
+//
+//	var seen []svc.State
+//	sw, _ := svchelper.GetServiceWrapper(service, "name", "name", "", false,
+//		svchelper.WithStatusObserver(func(s svc.Status) { seen = append(seen, s.State) }))
+//	changes := make(chan svc.Status, 10)
+//	requests := make(chan svc.ChangeRequest, 1)
+//	requests <- svc.ChangeRequest{Cmd: svc.Stop}
+//	sw.Execute(nil, requests, changes)
+func WithStatusObserver(observer func(svc.Status)) Option {
+	return func(sw *ServiceWrapper) error {
+		sw.statusObserver = observer
+		return nil
+	}
+}
+
+// InstallHook is run by InstallService with the resolved executable path and
+// the config the service is installed with.
+type InstallHook func(exePath string, config mgr.Config) error
+
+// WithPreInstall runs hook before the service is created, e.g. to create
+// directories or write a default config. If it fails nothing is installed.
+func WithPreInstall(hook InstallHook) Option {
+	return func(sw *ServiceWrapper) error {
+		sw.preInstall = hook
+		return nil
+	}
+}
+
+// WithPostInstall runs hook once the service is created and configured, e.g.
+// to set ACLs. If it fails the service is removed again.
+func WithPostInstall(hook InstallHook) Option {
+	return func(sw *ServiceWrapper) error {
+		sw.postInstall = hook
+		return nil
+	}
+}
+
+// RemoveHook is run by RemoveService with the service name and the
+// executable path the service was installed with.
+type RemoveHook func(serviceName, exePath string) error
+
+// WithPreRemove runs hook before the service is deleted, e.g. to back up
+// data. If it fails the service is left installed.
+func WithPreRemove(hook RemoveHook) Option {
+	return func(sw *ServiceWrapper) error {
+		sw.preRemove = hook
+		return nil
+	}
+}
+
+// WithPostRemove runs hook after the service is deleted, e.g. to clean up
+// data directories or firewall rules. As the deletion cannot be undone, a
+// failure is only reported on stderr.
+func WithPostRemove(hook RemoveHook) Option {
+	return func(sw *ServiceWrapper) error {
+		sw.postRemove = hook
+		return nil
+	}
+}
+
+// WithCommandAliases adds alternative names for the ManageService commands,
+// mapping each alias onto a built-in command, e.g. "uninstall" onto
+// "remove". Aliases are case-insensitive and must not shadow a command.
+func WithCommandAliases(aliases map[string]string) Option {
+	return func(sw *ServiceWrapper) error {
+		if sw.commandAliases == nil {
+			sw.commandAliases = make(map[string]string, len(aliases))
+		}
+		for alias, cmd := range aliases {
+			alias, cmd = strings.ToLower(alias), strings.ToLower(cmd)
+			if alias == "" {
+				return fmt.Errorf("command alias must not be empty")
+			}
+			if isCommand(alias) {
+				return fmt.Errorf("command alias %s collides with a built-in command", alias)
+			}
+			if !isCommand(cmd) {
+				return fmt.Errorf("command alias %s refers to unknown command %s", alias, cmd)
+			}
+			sw.commandAliases[alias] = cmd
+		}
+		return nil
+	}
+}
+
+// WithHealthEndpoint serves GET /healthz on addr while the service runs,
+// answering 200 when healthy and 503 when the HealthChecker of the service
+// reports an error. The service fails to start if addr cannot be bound.
+func WithHealthEndpoint(addr string) Option {
+	return func(sw *ServiceWrapper) error {
+		if addr == "" {
+			return fmt.Errorf("health endpoint address must not be empty")
+		}
+		sw.healthAddr = addr
+		return nil
+	}
+}
+
+// WithLivenessFile makes the running service update the modification time
+// of the file at path every interval, for an external watchdog to monitor.
+// The file is created once the service is running and removed when it
+// stops; while a HealthChecker reports the service unhealthy the file is not
+// touched. A relative path is resolved with ResolvePath.
+func WithLivenessFile(path string, interval time.Duration) Option {
+	return func(sw *ServiceWrapper) error {
+		if path == "" {
+			return fmt.Errorf("liveness file path must not be empty")
+		}
+		if interval <= 0 {
+			return fmt.Errorf("liveness interval must be positive, not %s", interval)
+		}
+		sw.livenessPath = path
+		sw.livenessInterval = interval
+		return nil
+	}
+}
+
+// WithRequiredPrivileges restricts the service process to the given
+// privileges, e.g. "SeChangeNotifyPrivilege"; the SCM removes all other
+// privileges of the service account from its token. Privileges the account
+// does not hold are not granted. This is independent of the service SID
+// type (see WithServiceSidType): required privileges trim the token, a
+// service SID adds a per-service identity to it, and least-privilege
+// services usually combine both.
+func WithRequiredPrivileges(privileges ...string) Option {
+	return func(sw *ServiceWrapper) error {
+		if err := validatePrivileges(privileges); err != nil {
+			return err
+		}
+		sw.requiredPrivileges = privileges
+		return nil
+	}
+}
+
+// WithServiceSidType sets the SID type of the service to one of
+// windows.SERVICE_SID_TYPE_NONE, SERVICE_SID_TYPE_UNRESTRICTED or
+// SERVICE_SID_TYPE_RESTRICTED. A restricted SID only grants the service
+// access to resources explicitly granted to its service SID.
+func WithServiceSidType(sidType uint32) Option {
+	return func(sw *ServiceWrapper) error {
+		switch sidType {
+		case windows.SERVICE_SID_TYPE_NONE, windows.SERVICE_SID_TYPE_UNRESTRICTED, windows.SERVICE_SID_TYPE_RESTRICTED:
+		default:
+			return fmt.Errorf("unknown service SID type %d", sidType)
+		}
+		sw.sidType = sidType
+		return nil
+	}
+}
+
+// WithServiceSDDL sets the DACL of the service object when it is installed
+// or reconfigured, e.g. to let a non-admin operator account start and stop
+// it. sddl must contain a DACL ("D:" followed by ACEs such as
+// "(A;;RPWPLCRC;;;<SID>)" granting start, stop, interrogate and read
+// control); owner, group and SACL parts are ignored. The DACL replaces the
+// default one entirely, so it should keep the usual entries for SYSTEM and
+// the administrators. Setting it needs WRITE_DAC on the service, which
+// administrators have.
+func WithServiceSDDL(sddl string) Option {
+	return func(sw *ServiceWrapper) error {
+		if _, err := parseServiceSDDL(sddl); err != nil {
+			return err
+		}
+		sw.serviceSDDL = sddl
+		return nil
+	}
+}
+
+// WithRestartOnFatal makes RunService start the service again after it
+// failed through Lifecycle.Fail or a fatal ExitError. Under the SCM the
+// service is started again once it has reported Stopped; a debug run starts
+// the executable again with the same arguments and returns its result. It
+// cannot be combined with a mgr.ServiceRestart recovery action, which would
+// restart the service a second time.
+//
+// The service is restarted at most 3 times in a row, 5 seconds after each
+// failure, unless WithRestartLimit says otherwise.
+func WithRestartOnFatal(enabled bool) Option {
+	return func(sw *ServiceWrapper) error {
+		sw.restartOnFatal = enabled
+		return nil
+	}
+}
+
+// WithRestartLimit sets how often WithRestartOnFatal restarts a service
+// failing again and again, and how long it waits before each restart. Once
+// the service has been restarted attempts times, RunService returns an
+// error rather than restarting it again.
+func WithRestartLimit(attempts int, delay time.Duration) Option {
+	return func(sw *ServiceWrapper) error {
+		if attempts < 1 {
+			return fmt.Errorf("restart attempts must be at least 1")
+		}
+		if delay < 0 {
+			return fmt.Errorf("restart delay must not be negative")
+		}
+		sw.maxRestarts = attempts
+		sw.restartDelay = delay
+		return nil
+	}
+}
+
+// WithBinaryCheck makes RunService log a warning when the installed
+// service runs another binary than the current one, see
+// VerifyBinaryMatches.
+func WithBinaryCheck() Option {
+	return func(sw *ServiceWrapper) error {
+		sw.verifyBinary = true
+		return nil
+	}
+}
+
+// ChangeRequestInterceptor sees each control request of a running service
+// before the wrapper does. Returning true means the request was handled and
+// the wrapper skips it, leaving any status update to ReportStatus.
+type ChangeRequestInterceptor func(c svc.ChangeRequest) (handled bool)
+
+// WithChangeRequestInterceptor sets a ChangeRequestInterceptor, for services
+// implementing their own control protocol on top of the wrapper. Stop
+// requests it handles do not stop the service.
+func WithChangeRequestInterceptor(interceptor ChangeRequestInterceptor) Option {
+	return func(sw *ServiceWrapper) error {
+		if interceptor == nil {
+			return fmt.Errorf("change request interceptor must not be nil")
+		}
+		sw.interceptor = interceptor
+		return nil
+	}
+}
+
+// WithParameters makes each run fill the struct dest points to with
+// LoadParameters before Schedule is called, and hand it to the service
+// through Lifecycle.Parameters. The run fails if the parameters cannot be
+// loaded.
+func WithParameters(dest any) Option {
+	return func(sw *ServiceWrapper) error {
+		v := reflect.ValueOf(dest)
+		if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+			return fmt.Errorf("parameters destination must be a pointer to a struct, got %T", dest)
+		}
+		sw.parameters = dest
+		return nil
+	}
+}
+
+// WithLockedOSThread runs each run of the service, from Schedule until the
+// service has stopped, on one locked OS thread, for thread-affine Windows
+// APIs. Only Schedule itself and other calls into the Service run there;
+// the goroutines the service starts are scheduled on other threads as
+// usual and must lock their own thread if they need one.
+func WithLockedOSThread(enabled bool) Option {
+	return func(sw *ServiceWrapper) error {
+		sw.lockOSThread = enabled
+		return nil
+	}
+}
+
+// WithCOMInit initializes COM with the given apartment model on the thread
+// running the service when it starts, and uninitializes it once the
+// service has stopped. The thread is locked for the run either way, so the
+// two calls pair up; COMApartmentThreaded also requires
+// WithLockedOSThread(true), as objects of a single-threaded apartment may
+// only be used from the thread that created it.
+func WithCOMInit(model COMModel) Option {
+	return func(sw *ServiceWrapper) error {
+		switch model {
+		case COMNone, COMMultiThreaded, COMApartmentThreaded:
+		default:
+			return fmt.Errorf("unknown COM model %d", model)
+		}
+		sw.comModel = model
+		return nil
+	}
+}
+
+// WithRecoveryActions sets what the SCM does on consecutive failures of the
+// service: restart it (mgr.ServiceRestart), run the command set by
+// WithRecoveryCommand (mgr.RunCommand) or reboot the machine
+// (mgr.ComputerReboot), each after its delay. The failure count is reset
+// after resetPeriod without failures.
+func WithRecoveryActions(actions []mgr.RecoveryAction, resetPeriod time.Duration) Option {
+	return func(sw *ServiceWrapper) error {
+		if err := validateRecoveryActions(actions); err != nil {
+			return err
+		}
+		if resetPeriod < 0 {
+			return fmt.Errorf("recovery reset period must not be negative, got %s", resetPeriod)
+		}
+		sw.recovery.Actions = actions
+		sw.recovery.ResetPeriod = resetPeriod
+		return nil
+	}
+}
+
+// WithRecoveryCommand sets the command line run by mgr.RunCommand recovery
+// actions.
+func WithRecoveryCommand(command string) Option {
+	return func(sw *ServiceWrapper) error {
+		if command == "" {
+			return fmt.Errorf("recovery command must not be empty")
+		}
+		sw.recovery.Command = command
+		return nil
+	}
+}
+
+// WithRebootMessage sets the message broadcast to users before a
+// mgr.ComputerReboot recovery action restarts the machine.
+func WithRebootMessage(message string) Option {
+	return func(sw *ServiceWrapper) error {
+		sw.recovery.RebootMessage = message
+		return nil
+	}
+}
+
+// WithRecoveryOnNonCrash sets whether the recovery actions also apply when
+// the service stops with a non-zero exit code, as it does after a fatal
+// error reported through Lifecycle.Fail or ExitErrorer.
+func WithRecoveryOnNonCrash(enabled bool) Option {
+	return func(sw *ServiceWrapper) error {
+		sw.recovery.OnNonCrash = enabled
+		sw.recoveryNonCrashSet = true
+		return nil
+	}
+}
+
+// isDriver reports whether the service is installed as a kernel or file
+// system driver.
+func (sw *ServiceWrapper) isDriver() bool {
+	return sw.serviceType == windows.SERVICE_KERNEL_DRIVER || sw.serviceType == windows.SERVICE_FILE_SYSTEM_DRIVER
+}
+
+func isLocalSystemAccount(account string) bool {
+	switch strings.ToLower(account) {
+	case "", "localsystem", `.\localsystem`, `nt authority\system`:
+		return true
+	}
+	return false
+}
+
+// virtualAccountPrefix is the domain of the virtual service accounts.
+const virtualAccountPrefix = `NT SERVICE\`
+
+func isVirtualAccount(account string) bool {
+	return len(account) > len(virtualAccountPrefix) && strings.EqualFold(account[:len(virtualAccountPrefix)], virtualAccountPrefix)
+}
+
+// effectiveSidType is the SID type the service is installed with: a virtual
+// account implies a service SID.
+func (sw *ServiceWrapper) effectiveSidType() uint32 {
+	if sw.sidType == windows.SERVICE_SID_TYPE_NONE && isVirtualAccount(sw.serviceAccount) {
+		return windows.SERVICE_SID_TYPE_UNRESTRICTED
+	}
+	return sw.sidType
+}
+
+// validate checks combinations of options that are invalid together.
+func (sw *ServiceWrapper) validate() error {
+	if sw.interactive && !isLocalSystemAccount(sw.serviceAccount) {
+		return fmt.Errorf("an interactive service must run as LocalSystem, not %s", sw.serviceAccount)
+	}
+	if sw.isDriver() {
+		switch {
+		case sw.driverPath == "":
+			return fmt.Errorf("a driver service requires WithDriverPath")
+		case sw.serviceAccount != "":
+			return fmt.Errorf("a driver service cannot run as %s", sw.serviceAccount)
+		case sw.interactive:
+			return fmt.Errorf("a driver service cannot be interactive")
+		case sw.preshutdownTimeout > 0:
+			return fmt.Errorf("a driver service cannot accept preshutdown notifications")
+		}
+	} else if sw.driverPath != "" {
+		return fmt.Errorf("WithDriverPath requires a driver service type")
+	} else if sw.startType == windows.SERVICE_BOOT_START || sw.startType == windows.SERVICE_SYSTEM_START {
+		return fmt.Errorf("start type %s requires a driver service type", startTypeString(sw.startType))
+	}
+	if hasRecoveryAction(sw.recovery.Actions, mgr.RunCommand) && sw.recovery.Command == "" {
+		return fmt.Errorf("a run-command recovery action requires WithRecoveryCommand")
+	}
+	if (sw.recovery.Command != "" || sw.recovery.RebootMessage != "") && len(sw.recovery.Actions) == 0 {
+		return fmt.Errorf("recovery command and reboot message require WithRecoveryActions")
+	}
+	if sw.restartOnFatal && hasRecoveryAction(sw.recovery.Actions, mgr.ServiceRestart) {
+		return fmt.Errorf("WithRestartOnFatal and a restart recovery action would both restart the service")
+	}
+	if sw.eventMessageFile != "" && sw.skipEventSource {
+		return fmt.Errorf("an event message file requires the event source to be registered")
+	}
+	if sw.comModel == COMApartmentThreaded && !sw.lockOSThread {
+		return fmt.Errorf("a single-threaded COM apartment requires WithLockedOSThread")
+	}
+	if isVirtualAccount(sw.serviceAccount) {
+		switch {
+		case !strings.EqualFold(sw.serviceAccount[len(virtualAccountPrefix):], sw.serviceName):
+			return fmt.Errorf("virtual account %s does not belong to the service %s", sw.serviceAccount, sw.serviceName)
+		case sw.servicePassword != "" || sw.passwordSource != nil:
+			return fmt.Errorf("virtual account %s has no password", sw.serviceAccount)
+		case sw.grantLogonRight:
+			return fmt.Errorf("virtual account %s holds the logon right already", sw.serviceAccount)
+		}
+	}
+	if sw.passwordSource != nil && isLocalSystemAccount(sw.serviceAccount) {
+		return fmt.Errorf("a password source requires a custom service account")
+	}
+	if sw.grantLogonRight && isLocalSystemAccount(sw.serviceAccount) {
+		return fmt.Errorf("granting the logon right requires a custom service account")
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/windows"
+)
+
+func TestNormalizeServiceName(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "MyService", want: "MyService"},
+		{name: "  MyService\t", want: "MyService"},
+		{name: "my service", want: "my service"},
+		{name: "MYSERVICE", want: "MYSERVICE"},
+		{name: strings.Repeat("a", maxServiceNameLength), want: strings.Repeat("a", maxServiceNameLength)},
+		{name: strings.Repeat("a", maxServiceNameLength+1), wantErr: true},
+		{name: strings.Repeat("ü", maxServiceNameLength), want: strings.Repeat("ü", maxServiceNameLength)},
+		{name: strings.Repeat("ü", maxServiceNameLength+1), wantErr: true},
+		{name: strings.Repeat("😀", maxServiceNameLength/2+1), wantErr: true}, // two UTF-16 units each
+		{name: "", wantErr: true},
+		{name: "   ", wantErr: true},
+		{name: "my/service", wantErr: true},
+		{name: `my\service`, wantErr: true},
+		{name: "my\x00service", wantErr: true},
+		{name: "my\nservice", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeServiceName(tt.name)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("normalizeServiceName(%q) = %q, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("normalizeServiceName(%q) failed: %v", tt.name, err)
+		} else if got != tt.want {
+			t.Errorf("normalizeServiceName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWithServiceType(t *testing.T) {
+	tests := []struct {
+		desc        string
+		serviceType uint32
+		opts        []Option
+		wantErr     bool
+	}{
+		{desc: "own process", serviceType: windows.SERVICE_WIN32_OWN_PROCESS},
+		{desc: "kernel driver", serviceType: windows.SERVICE_KERNEL_DRIVER, opts: []Option{WithDriverPath(`C:\drivers\test.sys`)}},
+		{desc: "file system driver", serviceType: windows.SERVICE_FILE_SYSTEM_DRIVER, opts: []Option{WithDriverPath(`C:\drivers\test.sys`)}},
+		{desc: "share process", serviceType: windows.SERVICE_WIN32_SHARE_PROCESS, wantErr: true},
+		{desc: "driver without a path", serviceType: windows.SERVICE_KERNEL_DRIVER, wantErr: true},
+		{desc: "unknown", serviceType: 0x1000, wantErr: true},
+	}
+	for _, tt := range tests {
+		opts := append([]Option{WithServiceType(tt.serviceType)}, tt.opts...)
+		_, err := GetServiceWrapper(idle, "svchelper-test", "svchelper test", "", false, opts...)
+		if tt.wantErr && err == nil {
+			t.Errorf("%s: GetServiceWrapper succeeded, want an error", tt.desc)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("%s: GetServiceWrapper failed: %v", tt.desc, err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// LoadParameters reads the values under the Parameters key of the service
+// into the struct dest points to. A field is filled from the value named by
+// its `registry` tag, or else from the value named like the field, ignoring
+// case; a tag of "-" skips the field. String values go into string fields,
+// multi-string values into []string fields, DWORD and QWORD values into
+// integer and bool fields and binary values into []byte fields. A
+// time.Duration field takes a string such as "30s" or a DWORD or QWORD of
+// milliseconds, the unit of the registry timeouts of Windows. Fields
+// without a value keep their contents.
+func (sw *ServiceWrapper) LoadParameters(dest any) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("parameters destination must be a pointer to a struct, got %T", dest)
+	}
+	values, err := sw.readParameters()
+	if err != nil {
+		return err
+	}
+	return unmarshalParameters(values, v.Elem())
+}
+
+// unmarshalParameters stores values in the fields of the struct v.
+func unmarshalParameters(values map[string]registryValue, v reflect.Value) error {
+	byName := make(map[string]registryValue, len(values))
+	for name, value := range values {
+		byName[strings.ToLower(name)] = value
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Name
+		if tag, ok := field.Tag.Lookup("registry"); ok {
+			if tag == "-" {
+				continue
+			}
+			name = tag
+		}
+		value, ok := byName[strings.ToLower(name)]
+		if !ok {
+			continue
+		}
+		if err := setParameterField(v.Field(i), value.value); err != nil {
+			return fmt.Errorf("when loading parameter %s into %s: %w", name, field.Name, err)
+		}
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func setParameterField(field reflect.Value, value any) error {
+	if field.Type() == durationType {
+		switch value := value.(type) {
+		case string:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return err
+			}
+			field.SetInt(int64(d))
+			return nil
+		case uint64:
+			if value > uint64(math.MaxInt64/time.Millisecond) {
+				return fmt.Errorf("%dms overflows %s", value, field.Type())
+			}
+			field.SetInt(int64(time.Duration(value) * time.Millisecond))
+			return nil
+		}
+	}
+	switch value := value.(type) {
+	case string:
+		if field.Kind() == reflect.String {
+			field.SetString(value)
+			return nil
+		}
+	case []string:
+		if field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String {
+			field.Set(reflect.ValueOf(value).Convert(field.Type()))
+			return nil
+		}
+	case []byte:
+		if field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Uint8 {
+			field.SetBytes(value)
+			return nil
+		}
+	case uint64:
+		switch field.Kind() {
+		case reflect.Bool:
+			field.SetBool(value != 0)
+			return nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if field.OverflowUint(value) {
+				return fmt.Errorf("%d overflows %s", value, field.Type())
+			}
+			field.SetUint(value)
+			return nil
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if int64(value) < 0 || field.OverflowInt(int64(value)) {
+				return fmt.Errorf("%d overflows %s", value, field.Type())
+			}
+			field.SetInt(int64(value))
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot store %T in a field of type %s", value, field.Type())
+}
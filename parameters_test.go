@@ -0,0 +1,92 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+type testParameters struct {
+	Name     string
+	Workers  int
+	Port     uint16
+	Verbose  bool
+	Interval time.Duration
+	Timeout  time.Duration
+	Hosts    []string `registry:"HostList"`
+	Skipped  string   `registry:"-"`
+	Kept     string
+	hidden   string
+}
+
+func TestUnmarshalParameters(t *testing.T) {
+	values := map[string]registryValue{
+		"name":     {registry.SZ, "worker"},
+		"Workers":  {registry.DWORD, uint64(4)},
+		"PORT":     {registry.DWORD, uint64(8080)},
+		"Verbose":  {registry.DWORD, uint64(1)},
+		"Interval": {registry.SZ, "1m30s"},
+		"Timeout":  {registry.DWORD, uint64(2500)},
+		"HostList": {registry.MULTI_SZ, []string{"a", "b"}},
+		"Skipped":  {registry.SZ, "set"},
+		"hidden":   {registry.SZ, "set"},
+	}
+	got := testParameters{Kept: "default"}
+	if err := unmarshalParameters(values, reflect.ValueOf(&got).Elem()); err != nil {
+		t.Fatalf("unmarshalParameters failed: %v", err)
+	}
+	want := testParameters{
+		Name:     "worker",
+		Workers:  4,
+		Port:     8080,
+		Verbose:  true,
+		Interval: 90 * time.Second,
+		Timeout:  2500 * time.Millisecond,
+		Hosts:    []string{"a", "b"},
+		Kept:     "default",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unmarshalParameters stored %+v, want %+v", got, want)
+	}
+}
+
+func TestUnmarshalParametersMismatch(t *testing.T) {
+	tests := []struct {
+		desc  string
+		name  string
+		value registryValue
+	}{
+		{desc: "string into int", name: "Workers", value: registryValue{registry.SZ, "4"}},
+		{desc: "DWORD into string", name: "Name", value: registryValue{registry.DWORD, uint64(1)}},
+		{desc: "string into []string", name: "HostList", value: registryValue{registry.SZ, "a"}},
+		{desc: "multi-string into bool", name: "Verbose", value: registryValue{registry.MULTI_SZ, []string{"1"}}},
+		{desc: "overflowing uint", name: "Port", value: registryValue{registry.DWORD, uint64(1 << 16)}},
+		{desc: "negative int", name: "Workers", value: registryValue{registry.QWORD, uint64(1 << 63)}},
+		{desc: "malformed duration", name: "Interval", value: registryValue{registry.SZ, "soon"}},
+		{desc: "binary into duration", name: "Timeout", value: registryValue{registry.BINARY, []byte{1}}},
+	}
+	for _, tt := range tests {
+		var got testParameters
+		if err := unmarshalParameters(map[string]registryValue{tt.name: tt.value}, reflect.ValueOf(&got).Elem()); err == nil {
+			t.Errorf("%s: unmarshalParameters succeeded, want an error", tt.desc)
+		}
+	}
+}
+
+func TestLoadParametersDestination(t *testing.T) {
+	sw := newTestWrapper(t, idle)
+	for _, dest := range []any{nil, testParameters{}, new(string)} {
+		if err := sw.LoadParameters(dest); err == nil {
+			t.Errorf("LoadParameters(%T) succeeded, want an error", dest)
+		}
+	}
+}
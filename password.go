@@ -0,0 +1,85 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// applyPassword fills in the account password of config from the source
+// set by WithServiceAccountPasswordEnv or WithServiceAccountPasswordPrompt.
+// The returned function zeroes the password buffer; the string copy in
+// config cannot be wiped, so callers drop config right after use.
+func (sw *ServiceWrapper) applyPassword(config *mgr.Config) (func(), error) {
+	if sw.passwordSource == nil {
+		return func() {}, nil
+	}
+	password, err := sw.passwordSource()
+	if err != nil {
+		return nil, err
+	}
+	config.Password = string(password)
+	return func() {
+		for i := range password {
+			password[i] = 0
+		}
+		config.Password = ""
+	}, nil
+}
+
+func passwordFromEnv(name string) ([]byte, error) {
+	password, ok := os.LookupEnv(name)
+	if !ok || password == "" {
+		return nil, fmt.Errorf("the password variable %s is not set", name)
+	}
+	return []byte(password), nil
+}
+
+// promptPassword reads a line from the console without echoing it.
+func promptPassword(prompt string) ([]byte, error) {
+	h := windows.Handle(os.Stdin.Fd())
+	var mode uint32
+	if err := windows.GetConsoleMode(h, &mode); err != nil {
+		return nil, fmt.Errorf("the password prompt needs a console: %v", err)
+	}
+	if err := windows.SetConsoleMode(h, mode&^windows.ENABLE_ECHO_INPUT); err != nil {
+		return nil, fmt.Errorf("could not disable console echo: %v", err)
+	}
+	defer windows.SetConsoleMode(h, mode)
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+	var password []byte
+	b := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			if b[0] != '\r' {
+				password = append(password, b[0])
+			}
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("when reading the password: %w", err)
+		}
+	}
+	if len(password) == 0 {
+		return nil, fmt.Errorf("no password entered")
+	}
+	return password, nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// PowerPolicy tells on which power source the service runs.
+type PowerPolicy int
+
+const (
+	PowerPolicyAny    PowerPolicy = iota // the service runs regardless of the power source
+	PowerPolicyACOnly                    // the service only runs on AC power
+)
+
+// pbtAPMPowerStatusChange is the power event sent when the power source or
+// the battery level changes.
+const pbtAPMPowerStatusChange = 0x000A
+
+var (
+	modkernel32              = windows.NewLazySystemDLL("kernel32.dll")
+	procGetSystemPowerStatus = modkernel32.NewProc("GetSystemPowerStatus")
+)
+
+// systemPowerStatus is SYSTEM_POWER_STATUS.
+type systemPowerStatus struct {
+	ACLineStatus        byte
+	BatteryFlag         byte
+	BatteryLifePercent  byte
+	SystemStatusFlag    byte
+	BatteryLifeTime     uint32
+	BatteryFullLifeTime uint32
+}
+
+// onBattery reports whether the machine runs on battery; tests replace it.
+var onBattery = systemOnBattery
+
+// systemOnBattery reports whether the machine runs on battery. An unknown
+// power source counts as AC, so machines without a battery are never
+// affected.
+func systemOnBattery() (bool, error) {
+	var status systemPowerStatus
+	r, _, e := procGetSystemPowerStatus.Call(uintptr(unsafe.Pointer(&status)))
+	if r == 0 {
+		return false, fmt.Errorf("GetSystemPowerStatus() failed: %v", e)
+	}
+	return status.ACLineStatus == 0, nil
+}
+
+// mustStopForPower reports whether the power policy rules out running on
+// the current power source.
+func (sw *ServiceWrapper) mustStopForPower() bool {
+	if sw.powerPolicy != PowerPolicyACOnly {
+		return false
+	}
+	battery, err := onBattery()
+	if err != nil {
+		elog.Warning(1, fmt.Sprintf("When checking the power source of the service '%s': %s", sw.serviceName, err))
+		return false
+	}
+	return battery
+}
@@ -0,0 +1,99 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// fakePowerSource makes the power source battery while the returned flag
+// is set, until the test ends. Each check of the power source is sent on
+// the returned channel if there is room.
+func fakePowerSource(t *testing.T) (*atomic.Bool, <-chan struct{}) {
+	var battery atomic.Bool
+	checked := make(chan struct{}, 10)
+	previous := onBattery
+	onBattery = func() (bool, error) {
+		select {
+		case checked <- struct{}{}:
+		default:
+		}
+		return battery.Load(), nil
+	}
+	t.Cleanup(func() { onBattery = previous })
+	return &battery, checked
+}
+
+func TestPowerPolicyOnBattery(t *testing.T) {
+	battery, _ := fakePowerSource(t)
+	battery.Store(true)
+	for _, tt := range []struct {
+		policy      PowerPolicy
+		wantRunning bool
+	}{
+		{policy: PowerPolicyACOnly, wantRunning: false},
+		{policy: PowerPolicyAny, wantRunning: true},
+	} {
+		e := newExecution()
+		sw := newTestWrapper(t, idle, WithStatusObserver(e.observe), WithPowerPolicy(tt.policy))
+		e.start(sw)
+		if tt.wantRunning {
+			e.waitFor(t, svc.Running)
+			e.send(svc.Stop)
+		}
+		if _, errno := e.wait(t); errno != 0 {
+			t.Errorf("policy %d: Execute returned errno %d, want a clean stop", tt.policy, errno)
+		}
+		if e.reported(svc.Running) != tt.wantRunning {
+			t.Errorf("policy %d: started on battery, reported Running = %t, want %t", tt.policy, !tt.wantRunning, tt.wantRunning)
+		}
+	}
+}
+
+func TestPowerPolicySwitchToBattery(t *testing.T) {
+	battery, checked := fakePowerSource(t)
+	e := newExecution()
+	sw := newTestWrapper(t, idle, WithStatusObserver(e.observe), WithPowerPolicy(PowerPolicyACOnly))
+	e.start(sw)
+	e.waitFor(t, svc.Running)
+	<-checked // at the start
+
+	// A power event on AC power, or other than a power source change,
+	// leaves the service running.
+	e.requests <- svc.ChangeRequest{Cmd: svc.PowerEvent, EventType: pbtAPMPowerStatusChange}
+	select {
+	case <-checked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the power event did not check the power source")
+	}
+	battery.Store(true)
+	e.requests <- svc.ChangeRequest{Cmd: svc.PowerEvent, EventType: pbtAPMPowerStatusChange + 1}
+	time.Sleep(50 * time.Millisecond)
+	if e.reported(svc.StopPending) {
+		t.Fatal("the service stopped for a power event that did not switch to battery")
+	}
+	e.requests <- svc.ChangeRequest{Cmd: svc.PowerEvent, EventType: pbtAPMPowerStatusChange}
+	if _, errno := e.wait(t); errno != 0 {
+		t.Errorf("Execute returned errno %d on the switch to battery, want a clean stop", errno)
+	}
+}
+
+func TestPowerPolicyInstallsNoTrigger(t *testing.T) {
+	sw := installTestService(t, WithPowerPolicy(PowerPolicyACOnly))
+	count, err := sw.triggerCount()
+	if err != nil {
+		t.Fatalf("triggerCount failed: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("the service is installed with %d triggers, want none", count)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+// isElevated reports whether the process runs with an elevated token.
+func isElevated() bool {
+	return windows.GetCurrentProcessToken().IsElevated()
+}
+
+// Preflight checks the prerequisites of InstallService and returns every
+// problem found rather than stopping at the first one. An empty result means
+// the install can go ahead.
+func (sw *ServiceWrapper) Preflight() []error {
+	var problems []error
+	if sw.remoteHost == "" && !isElevated() {
+		problems = append(problems, errors.New("the process is not elevated"))
+	}
+	if _, err := normalizeServiceName(sw.serviceName); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := sw.ExePath(); err != nil {
+		problems = append(problems, fmt.Errorf("the executable path cannot be resolved: %w", err))
+	}
+	if err := sw.checkLogonRight(lsaPolicy{host: sw.remoteHost}); err != nil {
+		problems = append(problems, err)
+	}
+	m, err := sw.connect()
+	if err != nil {
+		return append(problems, fmt.Errorf("the SCM is not reachable: %w", err))
+	}
+	m.Disconnect()
+	installed, err := sw.IsInstalled()
+	switch {
+	case err != nil:
+		problems = append(problems, err)
+	case installed:
+		problems = append(problems, fmt.Errorf("service %s already exists", sw.serviceName))
+		if sw.usesEventSource() {
+			if registered, err := sw.EventSourceRegistered(); err != nil {
+				problems = append(problems, err)
+			} else if !registered {
+				problems = append(problems, fmt.Errorf("service %s has no event source registered, EnsureInstalled repairs that", sw.serviceName))
+			}
+		}
+	}
+	return problems
+}
+
+// accountPolicy is the part of the LSA policy checkLogonRight queries.
+type accountPolicy interface {
+	HasAccountRight(account, right string) (bool, error)
+}
+
+// lsaPolicy is the accountPolicy of the LSA of host.
+type lsaPolicy struct {
+	host string
+}
+
+func (p lsaPolicy) HasAccountRight(account, right string) (bool, error) {
+	return hasAccountRight(p.host, account, right)
+}
+
+// checkLogonRight returns a problem if the service account does not hold
+// the logon right in policy and WithGrantLogonRight does not grant it.
+func (sw *ServiceWrapper) checkLogonRight(policy accountPolicy) error {
+	// A virtual account only exists once the service does, and holds the
+	// logon right through NT SERVICE\ALL SERVICES.
+	if isLocalSystemAccount(sw.serviceAccount) || isVirtualAccount(sw.serviceAccount) || sw.grantLogonRight {
+		return nil
+	}
+	held, err := policy.HasAccountRight(sw.serviceAccount, serviceLogonRight)
+	if err != nil {
+		return fmt.Errorf("the rights of %s cannot be checked: %w", sw.serviceAccount, err)
+	}
+	if !held {
+		return fmt.Errorf("account %s does not hold %s, the service will fail to start unless WithGrantLogonRight is set", sw.serviceAccount, serviceLogonRight)
+	}
+	return nil
+}
+
+func (sw *ServiceWrapper) printPreflight() error {
+	problems := sw.Preflight()
+	for _, problem := range problems {
+		fmt.Printf("FAIL: %s\n", problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d preflight check(s) failed", len(problems))
+	}
+	fmt.Println("OK: ready to install")
+	return nil
+}
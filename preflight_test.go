@@ -0,0 +1,96 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// fakePolicy is an accountPolicy holding rights per account.
+type fakePolicy struct {
+	rights  map[string][]string
+	err     error
+	queries []string
+}
+
+func (p *fakePolicy) HasAccountRight(account, right string) (bool, error) {
+	p.queries = append(p.queries, account)
+	if p.err != nil {
+		return false, p.err
+	}
+	for _, held := range p.rights[account] {
+		if held == right {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func TestCheckLogonRight(t *testing.T) {
+	lookupFailed := errors.New("no such account")
+	tests := []struct {
+		desc      string
+		opts      []Option
+		policy    *fakePolicy
+		wantErr   string
+		wantQuery bool
+	}{
+		{
+			desc:      "has the right",
+			opts:      []Option{WithServiceAccount(`.\svc-user`, "secret")},
+			policy:    &fakePolicy{rights: map[string][]string{`.\svc-user`: {"SeBatchLogonRight", serviceLogonRight}}},
+			wantQuery: true,
+		},
+		{
+			desc:      "lacks the right",
+			opts:      []Option{WithServiceAccount(`.\svc-user`, "secret")},
+			policy:    &fakePolicy{rights: map[string][]string{`.\svc-user`: {"SeBatchLogonRight"}}},
+			wantErr:   "does not hold " + serviceLogonRight,
+			wantQuery: true,
+		},
+		{
+			desc:      "policy fails",
+			opts:      []Option{WithServiceAccount(`.\svc-user`, "secret")},
+			policy:    &fakePolicy{err: lookupFailed},
+			wantErr:   "cannot be checked",
+			wantQuery: true,
+		},
+		{
+			desc:   "right granted at install",
+			opts:   []Option{WithServiceAccount(`.\svc-user`, "secret"), WithGrantLogonRight()},
+			policy: &fakePolicy{},
+		},
+		{
+			desc:   "LocalSystem",
+			policy: &fakePolicy{},
+		},
+		{
+			desc:   "virtual account",
+			opts:   []Option{WithVirtualServiceAccount()},
+			policy: &fakePolicy{},
+		},
+	}
+	for _, tt := range tests {
+		sw := newTestWrapper(t, idle, tt.opts...)
+		err := sw.checkLogonRight(tt.policy)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: checkLogonRight returned %v, want no problem", tt.desc, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: checkLogonRight returned %v, want a problem containing %q", tt.desc, err, tt.wantErr)
+		}
+		if tt.policy.err != nil && !errors.Is(err, tt.policy.err) {
+			t.Errorf("%s: checkLogonRight returned %v, want it to wrap the policy error", tt.desc, err)
+		}
+		if queried := len(tt.policy.queries) > 0; queried != tt.wantQuery {
+			t.Errorf("%s: the policy was queried %d times", tt.desc, len(tt.policy.queries))
+		}
+	}
+}
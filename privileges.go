@@ -0,0 +1,153 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// knownPrivileges are the privilege names the SCM accepts in
+// SERVICE_REQUIRED_PRIVILEGES_INFO.
+var knownPrivileges = map[string]bool{
+	"SeAssignPrimaryTokenPrivilege":             true,
+	"SeAuditPrivilege":                          true,
+	"SeBackupPrivilege":                         true,
+	"SeChangeNotifyPrivilege":                   true,
+	"SeCreateGlobalPrivilege":                   true,
+	"SeCreatePagefilePrivilege":                 true,
+	"SeCreatePermanentPrivilege":                true,
+	"SeCreateSymbolicLinkPrivilege":             true,
+	"SeCreateTokenPrivilege":                    true,
+	"SeDebugPrivilege":                          true,
+	"SeDelegateSessionUserImpersonatePrivilege": true,
+	"SeEnableDelegationPrivilege":               true,
+	"SeImpersonatePrivilege":                    true,
+	"SeIncreaseBasePriorityPrivilege":           true,
+	"SeIncreaseQuotaPrivilege":                  true,
+	"SeIncreaseWorkingSetPrivilege":             true,
+	"SeLoadDriverPrivilege":                     true,
+	"SeLockMemoryPrivilege":                     true,
+	"SeMachineAccountPrivilege":                 true,
+	"SeManageVolumePrivilege":                   true,
+	"SeProfileSingleProcessPrivilege":           true,
+	"SeRelabelPrivilege":                        true,
+	"SeRemoteShutdownPrivilege":                 true,
+	"SeRestorePrivilege":                        true,
+	"SeSecurityPrivilege":                       true,
+	"SeShutdownPrivilege":                       true,
+	"SeSyncAgentPrivilege":                      true,
+	"SeSystemEnvironmentPrivilege":              true,
+	"SeSystemProfilePrivilege":                  true,
+	"SeSystemtimePrivilege":                     true,
+	"SeTakeOwnershipPrivilege":                  true,
+	"SeTcbPrivilege":                            true,
+	"SeTimeZonePrivilege":                       true,
+	"SeTrustedCredManAccessPrivilege":           true,
+	"SeUndockPrivilege":                         true,
+}
+
+func validatePrivileges(privileges []string) error {
+	if len(privileges) == 0 {
+		return fmt.Errorf("at least one privilege is required")
+	}
+	for _, privilege := range privileges {
+		if !knownPrivileges[privilege] {
+			return fmt.Errorf("unknown privilege %q", privilege)
+		}
+	}
+	return nil
+}
+
+// requiredPrivilegesInfo is SERVICE_REQUIRED_PRIVILEGES_INFO.
+type requiredPrivilegesInfo struct {
+	RequiredPrivileges *uint16 // double-NUL terminated list
+}
+
+func setRequiredPrivileges(s *mgr.Service, privileges []string) error {
+	var multiSz []uint16
+	for _, privilege := range privileges {
+		multiSz = append(multiSz, windows.StringToUTF16(privilege)...)
+	}
+	multiSz = append(multiSz, 0)
+	info := requiredPrivilegesInfo{RequiredPrivileges: &multiSz[0]}
+	if err := windows.ChangeServiceConfig2(s.Handle, windows.SERVICE_CONFIG_REQUIRED_PRIVILEGES_INFO, (*byte)(unsafe.Pointer(&info))); err != nil {
+		return fmt.Errorf("could not set the required privileges: %v", err)
+	}
+	return nil
+}
+
+// RequiredPrivileges returns the privileges the installed service is
+// restricted to, or nil when it keeps all privileges of its account.
+func (sw *ServiceWrapper) RequiredPrivileges() ([]string, error) {
+	var privileges []string
+	err := sw.queryService(func(s *mgr.Service) error {
+		b, err := queryServiceConfig2(s, windows.SERVICE_CONFIG_REQUIRED_PRIVILEGES_INFO)
+		if err != nil {
+			return fmt.Errorf("could not retrieve the required privileges: %v", err)
+		}
+		info := (*requiredPrivilegesInfo)(unsafe.Pointer(&b[0]))
+		if info.RequiredPrivileges == nil {
+			return nil
+		}
+		for p := info.RequiredPrivileges; *p != 0; {
+			privilege := windows.UTF16PtrToString(p)
+			privileges = append(privileges, privilege)
+			p = (*uint16)(unsafe.Add(unsafe.Pointer(p), (len(windows.StringToUTF16(privilege)))*2))
+		}
+		return nil
+	})
+	return privileges, err
+}
+
+// ServiceSidType returns the SID type of the installed service, one of the
+// windows.SERVICE_SID_TYPE_* constants.
+func (sw *ServiceWrapper) ServiceSidType() (uint32, error) {
+	var sidType uint32
+	err := sw.queryService(func(s *mgr.Service) error {
+		config, err := s.Config()
+		if err != nil {
+			return fmt.Errorf("could not retrieve the service SID type: %v", err)
+		}
+		sidType = config.SidType
+		return nil
+	})
+	return sidType, err
+}
+
+// withPrivilege runs f with the named privilege enabled in the process
+// token, restoring its previous state afterwards. Privileges an
+// administrator holds, such as SeShutdownPrivilege, are still disabled by
+// default.
+func withPrivilege(name string, f func() error) error {
+	var token windows.Token
+	if err := windows.OpenProcessToken(windows.CurrentProcess(), windows.TOKEN_ADJUST_PRIVILEGES|windows.TOKEN_QUERY, &token); err != nil {
+		return fmt.Errorf("OpenProcessToken() failed: %w", err)
+	}
+	defer token.Close()
+	var luid windows.LUID
+	if err := windows.LookupPrivilegeValue(nil, syscall.StringToUTF16Ptr(name), &luid); err != nil {
+		return fmt.Errorf("LookupPrivilegeValue(%s) failed: %w", name, err)
+	}
+	enable := windows.Tokenprivileges{
+		PrivilegeCount: 1,
+		Privileges:     [1]windows.LUIDAndAttributes{{Luid: luid, Attributes: windows.SE_PRIVILEGE_ENABLED}},
+	}
+	var previous windows.Tokenprivileges
+	var size uint32
+	if err := windows.AdjustTokenPrivileges(token, false, &enable, uint32(unsafe.Sizeof(previous)), &previous, &size); err != nil {
+		return fmt.Errorf("when enabling %s: %w", name, err)
+	}
+	// previous lists no privilege when it was enabled already.
+	defer windows.AdjustTokenPrivileges(token, false, &previous, 0, nil, nil)
+	return f()
+}
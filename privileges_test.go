@@ -0,0 +1,56 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.org/x/sys/windows"
+)
+
+func TestRequiredPrivilegesRoundTrip(t *testing.T) {
+	want := []string{"SeChangeNotifyPrivilege", "SeImpersonatePrivilege", "SeCreateGlobalPrivilege"}
+	sw := installTestService(t, WithRequiredPrivileges(want...), WithServiceSidType(windows.SERVICE_SID_TYPE_UNRESTRICTED))
+	got, err := sw.RequiredPrivileges()
+	if err != nil {
+		t.Fatalf("RequiredPrivileges failed: %v", err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("RequiredPrivileges() = %v, want %v", got, want)
+	}
+	sidType, err := sw.ServiceSidType()
+	if err != nil {
+		t.Fatalf("ServiceSidType failed: %v", err)
+	}
+	if sidType != windows.SERVICE_SID_TYPE_UNRESTRICTED {
+		t.Errorf("ServiceSidType() = %d, want %d", sidType, windows.SERVICE_SID_TYPE_UNRESTRICTED)
+	}
+}
+
+func TestValidatePrivileges(t *testing.T) {
+	tests := []struct {
+		privileges []string
+		wantErr    bool
+	}{
+		{privileges: []string{"SeChangeNotifyPrivilege"}},
+		{privileges: []string{"SeChangeNotifyPrivilege", "SeShutdownPrivilege"}},
+		{privileges: nil, wantErr: true},
+		{privileges: []string{"SeNoSuchPrivilege"}, wantErr: true},
+		{privileges: []string{"sechangenotifyprivilege"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		err := validatePrivileges(tt.privileges)
+		if tt.wantErr && err == nil {
+			t.Errorf("validatePrivileges(%q) succeeded, want an error", tt.privileges)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("validatePrivileges(%q) failed: %v", tt.privileges, err)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// WrapperInfo describes the service identity the binary is configured with
+// and, when the service is installed, its live state.
+type WrapperInfo struct {
+	ServiceName string
+	DisplayName string
+	Description string
+	ExePath     string
+	StartType   uint32
+	Installed   bool
+	State       svc.State // only set when Installed
+	ProcessID   uint32    // only set while running
+}
+
+// withService runs f with the installed service, returning ErrNotInstalled
+// if it does not exist.
+func (sw *ServiceWrapper) withService(f func(s *mgr.Service) error) error {
+	m, err := sw.connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(sw.serviceName)
+	if errors.Is(err, windows.ERROR_SERVICE_DOES_NOT_EXIST) {
+		return fmt.Errorf("%s: %w", sw.serviceName, ErrNotInstalled)
+	}
+	if err != nil {
+		return fmt.Errorf("could not access service: %v", err)
+	}
+	defer s.Close()
+	return f(s)
+}
+
+// serviceReadAccess are the rights on a service the queries need, which
+// standard users are granted by the default service security descriptor.
+const serviceReadAccess = windows.SERVICE_QUERY_STATUS | windows.SERVICE_QUERY_CONFIG | windows.SERVICE_ENUMERATE_DEPENDENTS
+
+func openServiceReadOnly(m *mgr.Mgr, name string) (*mgr.Service, error) {
+	h, err := windows.OpenService(m.Handle, syscall.StringToUTF16Ptr(name), serviceReadAccess)
+	if err != nil {
+		return nil, err
+	}
+	return &mgr.Service{Name: name, Handle: h}, nil
+}
+
+// queryService is withService for read-only operations. It connects with
+// reduced rights, so that it works without elevation.
+func (sw *ServiceWrapper) queryService(f func(s *mgr.Service) error) error {
+	m, err := sw.connectReadOnly()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := openServiceReadOnly(m, sw.serviceName)
+	if errors.Is(err, windows.ERROR_SERVICE_DOES_NOT_EXIST) {
+		return fmt.Errorf("%s: %w", sw.serviceName, ErrNotInstalled)
+	}
+	if err != nil {
+		return fmt.Errorf("could not access service: %v", err)
+	}
+	defer s.Close()
+	return f(s)
+}
+
+// IsInstalled reports whether the service is registered with the SCM.
+func (sw *ServiceWrapper) IsInstalled() (bool, error) {
+	m, err := sw.connectReadOnly()
+	if err != nil {
+		return false, err
+	}
+	defer m.Disconnect()
+	s, err := openServiceReadOnly(m, sw.serviceName)
+	if errors.Is(err, windows.ERROR_SERVICE_DOES_NOT_EXIST) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not access service: %v", err)
+	}
+	s.Close()
+	return true, nil
+}
+
+// WrapperInfo returns the configured service identity. The live state is
+// only filled in when the service is installed.
+func (sw *ServiceWrapper) WrapperInfo() (WrapperInfo, error) {
+	config := sw.serviceConfig()
+	info := WrapperInfo{
+		ServiceName: sw.serviceName,
+		DisplayName: config.DisplayName,
+		Description: config.Description,
+		StartType:   config.StartType,
+	}
+	exepath, err := sw.ExePath()
+	if err != nil {
+		return info, fmt.Errorf("when resolving the executable path: %w", err)
+	}
+	info.ExePath = exepath
+	m, err := sw.connectReadOnly()
+	if err != nil {
+		return info, err
+	}
+	defer m.Disconnect()
+	s, err := openServiceReadOnly(m, sw.serviceName)
+	if errors.Is(err, windows.ERROR_SERVICE_DOES_NOT_EXIST) {
+		return info, nil
+	}
+	if err != nil {
+		return info, fmt.Errorf("could not access service: %v", err)
+	}
+	defer s.Close()
+	status, err := s.Query()
+	if err != nil {
+		return info, fmt.Errorf("could not retrieve service status: %v", err)
+	}
+	info.Installed = true
+	info.State = status.State
+	info.ProcessID = status.ProcessId
+	return info, nil
+}
+
+// wrapperInfoJSON is the JSON form of WrapperInfo.
+type wrapperInfoJSON struct {
+	ServiceName string `json:"service_name"`
+	DisplayName string `json:"display_name"`
+	Description string `json:"description"`
+	ExePath     string `json:"exe_path"`
+	StartType   string `json:"start_type"`
+	Installed   bool   `json:"installed"`
+	State       string `json:"state,omitempty"`
+	PID         uint32 `json:"pid,omitempty"`
+}
+
+// StatusJSON returns WrapperInfo as a JSON object for scripts, with the
+// start type and state as names, e.g. "automatic" and "Running".
+func (sw *ServiceWrapper) StatusJSON() ([]byte, error) {
+	info, err := sw.WrapperInfo()
+	if err != nil {
+		return nil, err
+	}
+	out := wrapperInfoJSON{
+		ServiceName: info.ServiceName,
+		DisplayName: info.DisplayName,
+		Description: info.Description,
+		ExePath:     info.ExePath,
+		StartType:   startTypeString(info.StartType),
+		Installed:   info.Installed,
+		PID:         info.ProcessID,
+	}
+	if info.Installed {
+		out.State = StateString(info.State)
+	}
+	return json.MarshalIndent(out, "", "  ")
+}
+
+// QueryStatus returns the current status of the installed service.
+func (sw *ServiceWrapper) QueryStatus() (svc.Status, error) {
+	var status svc.Status
+	err := sw.queryService(func(s *mgr.Service) error {
+		var err error
+		status, err = s.Query()
+		if err != nil {
+			return fmt.Errorf("could not retrieve service status: %v", err)
+		}
+		return nil
+	})
+	return status, err
+}
+
+// InstalledCommandLine returns the program and arguments the SCM runs for
+// the installed service, parsed from its registered image path.
+func (sw *ServiceWrapper) InstalledCommandLine() (string, []string, error) {
+	var commandLine []string
+	err := sw.queryService(func(s *mgr.Service) error {
+		config, err := s.Config()
+		if err != nil {
+			return fmt.Errorf("could not retrieve service config: %v", err)
+		}
+		commandLine, err = windows.DecomposeCommandLine(config.BinaryPathName)
+		if err != nil {
+			return fmt.Errorf("could not parse the image path %q: %v", config.BinaryPathName, err)
+		}
+		if len(commandLine) == 0 {
+			return fmt.Errorf("the image path of %s is empty", sw.serviceName)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return commandLine[0], commandLine[1:], nil
+}
+
+// Dependencies returns the services the installed service depends on.
+func (sw *ServiceWrapper) Dependencies() ([]string, error) {
+	var dependencies []string
+	err := sw.queryService(func(s *mgr.Service) error {
+		config, err := s.Config()
+		if err != nil {
+			return fmt.Errorf("could not retrieve service config: %v", err)
+		}
+		dependencies = config.Dependencies
+		return nil
+	})
+	return dependencies, err
+}
+
+// Dependents returns the services depending on the installed service, which
+// the SCM refuses to leave running when it is stopped.
+func (sw *ServiceWrapper) Dependents() ([]string, error) {
+	var dependents []string
+	err := sw.queryService(func(s *mgr.Service) error {
+		var err error
+		dependents, err = s.ListDependentServices(svc.AnyActivity)
+		if err != nil {
+			return fmt.Errorf("could not list dependent services: %v", err)
+		}
+		return nil
+	})
+	return dependents, err
+}
+
+// Info is the live state and config of the installed service, as returned
+// by ServiceInfo. ProcessID, Accepts and StartTime are only set while the
+// service has a process, ExitCode only once it has stopped.
+type Info struct {
+	Name           string
+	DisplayName    string
+	Description    string
+	State          svc.State
+	ProcessID      uint32
+	Accepts        svc.Accepted
+	ExitCode       uint32 // the service-specific code if one was reported
+	StartTime      time.Time
+	StartType      uint32
+	ServiceType    uint32
+	Account        string
+	BinaryPathName string
+	Dependencies   []string
+}
+
+// ServiceInfo returns the state and config of the installed service in one
+// call, querying the SCM only for the status and the config. StartTime is
+// the creation time of the service process, the nearest available stand-in
+// for the time of the last start, and stays zero if it cannot be read.
+func (sw *ServiceWrapper) ServiceInfo() (Info, error) {
+	info := Info{Name: sw.serviceName}
+	err := sw.queryService(func(s *mgr.Service) error {
+		status, err := s.Query()
+		if err != nil {
+			return fmt.Errorf("could not retrieve service status: %v", err)
+		}
+		config, err := s.Config()
+		if err != nil {
+			return fmt.Errorf("could not retrieve service config: %v", err)
+		}
+		info.DisplayName = config.DisplayName
+		info.Description = config.Description
+		info.State = status.State
+		info.ProcessID = status.ProcessId
+		info.Accepts = status.Accepts
+		if status.State == svc.Stopped {
+			info.ExitCode = serviceExitCode(status)
+		}
+		info.StartType = config.StartType
+		info.ServiceType = config.ServiceType
+		info.Account = config.ServiceStartName
+		info.BinaryPathName = config.BinaryPathName
+		info.Dependencies = config.Dependencies
+		return nil
+	})
+	if err != nil {
+		return info, err
+	}
+	if info.ProcessID != 0 && sw.remoteHost == "" {
+		info.StartTime = processStartTime(info.ProcessID)
+	}
+	return info, nil
+}
+
+// processStartTime returns the creation time of the process pid, or the
+// zero time if it cannot be read.
+func processStartTime(pid uint32) time.Time {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return time.Time{}
+	}
+	defer windows.CloseHandle(h)
+	var creation, exit, kernel, user windows.Filetime
+	if err := windows.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, creation.Nanoseconds())
+}
+
+// VerifyBinaryMatches reports whether the installed service runs the
+// executable of the current process, comparing the paths case-insensitively.
+// A mismatch means the service was installed from another location.
+func (sw *ServiceWrapper) VerifyBinaryMatches() (bool, error) {
+	executablePath, err := os.Executable()
+	if err != nil {
+		return false, fmt.Errorf("when getting executable path: %s", err)
+	}
+	program, _, err := sw.InstalledCommandLine()
+	if err != nil {
+		return false, err
+	}
+	return samePath(program, executablePath), nil
+}
+
+// ProcessID returns the process ID of the running service. It returns an
+// error wrapping ErrNotRunning while the service has no process.
+func (sw *ServiceWrapper) ProcessID() (uint32, error) {
+	status, err := sw.QueryStatus()
+	if err != nil {
+		return 0, err
+	}
+	if status.ProcessId == 0 {
+		return 0, fmt.Errorf("%s is %s: %w", sw.serviceName, StateString(status.State), ErrNotRunning)
+	}
+	return status.ProcessId, nil
+}
+
+// queryServiceConfig2 returns the raw QueryServiceConfig2 data of s at the
+// given info level. Pointers in the data refer into the returned buffer.
+func queryServiceConfig2(s *mgr.Service, infoLevel uint32) ([]byte, error) {
+	n := uint32(1024)
+	for {
+		b := make([]byte, n)
+		err := windows.QueryServiceConfig2(s.Handle, infoLevel, &b[0], n, &n)
+		if err == nil {
+			return b, nil
+		}
+		if err.(syscall.Errno) != syscall.ERROR_INSUFFICIENT_BUFFER {
+			return nil, err
+		}
+		if n <= uint32(len(b)) {
+			return nil, err
+		}
+	}
+}
+
+// preshutdownInfo is SERVICE_PRESHUTDOWN_INFO.
+type preshutdownInfo struct {
+	PreshutdownTimeout uint32
+}
+
+func setPreshutdownTimeout(s *mgr.Service, timeout time.Duration) error {
+	info := preshutdownInfo{PreshutdownTimeout: uint32(timeout / time.Millisecond)}
+	if err := windows.ChangeServiceConfig2(s.Handle, windows.SERVICE_CONFIG_PRESHUTDOWN_INFO, (*byte)(unsafe.Pointer(&info))); err != nil {
+		return fmt.Errorf("could not set the preshutdown timeout: %v", err)
+	}
+	return nil
+}
+
+// PreshutdownTimeout returns how long the SCM waits for the installed
+// service to handle a preshutdown notification.
+func (sw *ServiceWrapper) PreshutdownTimeout() (time.Duration, error) {
+	var timeout time.Duration
+	err := sw.queryService(func(s *mgr.Service) error {
+		var err error
+		timeout, err = queryPreshutdownTimeout(s)
+		return err
+	})
+	return timeout, err
+}
+
+func queryPreshutdownTimeout(s *mgr.Service) (time.Duration, error) {
+	b, err := queryServiceConfig2(s, windows.SERVICE_CONFIG_PRESHUTDOWN_INFO)
+	if err != nil {
+		return 0, fmt.Errorf("could not retrieve the preshutdown timeout: %v", err)
+	}
+	info := (*preshutdownInfo)(unsafe.Pointer(&b[0]))
+	return time.Duration(info.PreshutdownTimeout) * time.Millisecond, nil
+}
+
+func startTypeString(startType uint32) string {
+	switch startType {
+	case mgr.StartAutomatic:
+		return "automatic"
+	case mgr.StartManual:
+		return "manual"
+	case mgr.StartDisabled:
+		return "disabled"
+	case windows.SERVICE_BOOT_START:
+		return "boot"
+	case windows.SERVICE_SYSTEM_START:
+		return "system"
+	}
+	return fmt.Sprintf("unknown (%d)", startType)
+}
@@ -0,0 +1,145 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+func TestDependenciesAndDependents(t *testing.T) {
+	base := installTestService(t)
+	dependent := newInstallWrapper(t, idle, WithDependencies(base.serviceName))
+	if err := dependent.setServiceName(base.serviceName + "-dependent"); err != nil {
+		t.Fatalf("setServiceName failed: %v", err)
+	}
+	install(t, dependent)
+
+	dependencies, err := dependent.Dependencies()
+	if err != nil {
+		t.Fatalf("Dependencies failed: %v", err)
+	}
+	if fmt.Sprint(dependencies) != fmt.Sprint([]string{base.serviceName}) {
+		t.Errorf("Dependencies() = %v, want [%s]", dependencies, base.serviceName)
+	}
+	dependents, err := base.Dependents()
+	if err != nil {
+		t.Fatalf("Dependents failed: %v", err)
+	}
+	if fmt.Sprint(dependents) != fmt.Sprint([]string{dependent.serviceName}) {
+		t.Errorf("Dependents() = %v, want [%s]", dependents, dependent.serviceName)
+	}
+	if dependencies, err := base.Dependencies(); err != nil || len(dependencies) != 0 {
+		t.Errorf("Dependencies() of the base service = %v, %v, want none", dependencies, err)
+	}
+}
+
+func TestReadOnlyAccess(t *testing.T) {
+	// The event log service runs on every machine, and standard users may
+	// query it, so the test needs no elevation.
+	sw := newTestWrapper(t, idle)
+	if err := sw.setServiceName("EventLog"); err != nil {
+		t.Fatalf("setServiceName failed: %v", err)
+	}
+	if installed, err := sw.IsInstalled(); err != nil || !installed {
+		t.Fatalf("IsInstalled() = %t, %v, want true", installed, err)
+	}
+	status, err := sw.QueryStatus()
+	if err != nil {
+		t.Fatalf("QueryStatus failed: %v", err)
+	}
+	if status.State != svc.Running {
+		t.Errorf("QueryStatus reports %s for the event log service, want running", StateString(status.State))
+	}
+	info, err := sw.ServiceInfo()
+	if err != nil {
+		t.Fatalf("ServiceInfo failed: %v", err)
+	}
+	if info.BinaryPathName == "" {
+		t.Error("ServiceInfo returned no command line")
+	}
+
+	// The read-only connection cannot change anything, not even elevated.
+	m, err := sw.connectReadOnly()
+	if err != nil {
+		t.Fatalf("connectReadOnly failed: %v", err)
+	}
+	defer m.Disconnect()
+	exepath := filepath.Join(os.Getenv("SystemRoot"), "System32", "svchost.exe")
+	s, err := m.CreateService("svchelper-test-"+t.Name(), exepath, mgr.Config{})
+	if err == nil {
+		s.Delete()
+		s.Close()
+		t.Fatal("CreateService through the read-only connection succeeded")
+	}
+	if !errors.Is(err, windows.ERROR_ACCESS_DENIED) {
+		t.Errorf("CreateService through the read-only connection returned %v, want ERROR_ACCESS_DENIED", err)
+	}
+	s, err = openServiceReadOnly(m, sw.serviceName)
+	if err != nil {
+		t.Fatalf("openServiceReadOnly failed: %v", err)
+	}
+	defer s.Close()
+	if _, err := s.Control(svc.Interrogate); !errors.Is(err, windows.ERROR_ACCESS_DENIED) {
+		t.Errorf("a control through the read-only handle returned %v, want ERROR_ACCESS_DENIED", err)
+	}
+}
+
+func TestServiceInfo(t *testing.T) {
+	sw := installTestService(t, WithStartType(mgr.StartManual))
+	info, err := sw.ServiceInfo()
+	if err != nil {
+		t.Fatalf("ServiceInfo failed: %v", err)
+	}
+	if info.Name != sw.serviceName || info.DisplayName != "svchelper test" {
+		t.Errorf("ServiceInfo names %q (%q), want %q (svchelper test)", info.Name, info.DisplayName, sw.serviceName)
+	}
+	if info.State != svc.Stopped || info.ProcessID != 0 || !info.StartTime.IsZero() {
+		t.Errorf("ServiceInfo of the stopped service = %+v, want no process", info)
+	}
+	if info.StartType != mgr.StartManual || info.ServiceType != windows.SERVICE_WIN32_OWN_PROCESS {
+		t.Errorf("ServiceInfo reports start type %s and service type %#x", startTypeString(info.StartType), info.ServiceType)
+	}
+	if !isLocalSystemAccount(info.Account) {
+		t.Errorf("ServiceInfo reports account %q, want LocalSystem", info.Account)
+	}
+	exepath, err := sw.ExePath()
+	if err != nil {
+		t.Fatalf("ExePath failed: %v", err)
+	}
+	if info.BinaryPathName != sw.binaryPathName(exepath) {
+		t.Errorf("ServiceInfo reports command line %s, want %s", info.BinaryPathName, sw.binaryPathName(exepath))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := sw.StartServiceContext(ctx); err != nil {
+		t.Fatalf("StartServiceContext failed: %v", err)
+	}
+	if info, err = sw.ServiceInfo(); err != nil {
+		t.Fatalf("ServiceInfo failed: %v", err)
+	}
+	if info.State != svc.Running || info.ProcessID == 0 {
+		t.Errorf("ServiceInfo of the running service reports state %s and process %d", StateString(info.State), info.ProcessID)
+	}
+	if info.Accepts&svc.AcceptStop == 0 {
+		t.Errorf("ServiceInfo reports the running service accepts %#x, want stop", info.Accepts)
+	}
+	if since := time.Since(info.StartTime); info.StartTime.IsZero() || since < 0 || since > time.Minute {
+		t.Errorf("ServiceInfo reports start time %s for a service just started", info.StartTime)
+	}
+}
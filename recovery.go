@@ -0,0 +1,136 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// RecoverySettings describes what the SCM does when the service fails.
+type RecoverySettings struct {
+	Actions       []mgr.RecoveryAction
+	ResetPeriod   time.Duration // after which the failure count is reset
+	Command       string        // run by mgr.RunCommand actions
+	RebootMessage string        // broadcast before mgr.ComputerReboot actions
+	// OnNonCrash also applies the actions when the service stops with a
+	// non-zero exit code rather than crashing.
+	OnNonCrash bool
+}
+
+func validateRecoveryActions(actions []mgr.RecoveryAction) error {
+	if len(actions) == 0 {
+		return fmt.Errorf("at least one recovery action is required")
+	}
+	for i, action := range actions {
+		switch action.Type {
+		case mgr.NoAction, mgr.ServiceRestart, mgr.RunCommand, mgr.ComputerReboot:
+		default:
+			return fmt.Errorf("recovery action %d has unknown type %d", i, action.Type)
+		}
+		if action.Delay < 0 {
+			return fmt.Errorf("recovery action %d has negative delay %s", i, action.Delay)
+		}
+	}
+	return nil
+}
+
+func hasRecoveryAction(actions []mgr.RecoveryAction, actionType int) bool {
+	for _, action := range actions {
+		if action.Type == actionType {
+			return true
+		}
+	}
+	return false
+}
+
+// setRecoveryActions sets the recovery actions of s. A reboot action needs
+// SeShutdownPrivilege, which is enabled for the call.
+func setRecoveryActions(s *mgr.Service, actions []mgr.RecoveryAction, resetPeriod uint32) error {
+	if !hasRecoveryAction(actions, mgr.ComputerReboot) {
+		return s.SetRecoveryActions(actions, resetPeriod)
+	}
+	return withPrivilege("SeShutdownPrivilege", func() error {
+		return s.SetRecoveryActions(actions, resetPeriod)
+	})
+}
+
+func (sw *ServiceWrapper) applyRecovery(s *mgr.Service) error {
+	if sw.recoveryNonCrashSet {
+		if err := s.SetRecoveryActionsOnNonCrashFailures(sw.recovery.OnNonCrash); err != nil {
+			return fmt.Errorf("could not set recovery flag: %v", err)
+		}
+	}
+	if len(sw.recovery.Actions) == 0 {
+		return nil
+	}
+	if err := setRecoveryActions(s, sw.recovery.Actions, uint32(sw.recovery.ResetPeriod/time.Second)); err != nil {
+		return fmt.Errorf("could not set recovery actions: %v", err)
+	}
+	if sw.recovery.Command != "" {
+		if err := s.SetRecoveryCommand(sw.recovery.Command); err != nil {
+			return fmt.Errorf("could not set recovery command: %v", err)
+		}
+	}
+	if sw.recovery.RebootMessage != "" {
+		if err := s.SetRebootMessage(sw.recovery.RebootMessage); err != nil {
+			return fmt.Errorf("could not set reboot message: %v", err)
+		}
+	}
+	return nil
+}
+
+// RecoveryConfig reads back the recovery settings of the installed service.
+func (sw *ServiceWrapper) RecoveryConfig() (RecoverySettings, error) {
+	var settings RecoverySettings
+	err := sw.queryService(func(s *mgr.Service) error {
+		var err error
+		settings, err = readRecovery(s)
+		return err
+	})
+	return settings, err
+}
+
+func readRecovery(s *mgr.Service) (RecoverySettings, error) {
+	var settings RecoverySettings
+	var err error
+	if settings.Actions, err = s.RecoveryActions(); err != nil {
+		return settings, fmt.Errorf("could not retrieve recovery actions: %v", err)
+	}
+	resetPeriod, err := s.ResetPeriod()
+	if err != nil {
+		return settings, fmt.Errorf("could not retrieve recovery reset period: %v", err)
+	}
+	settings.ResetPeriod = time.Duration(resetPeriod) * time.Second
+	if settings.Command, err = s.RecoveryCommand(); err != nil {
+		return settings, fmt.Errorf("could not retrieve recovery command: %v", err)
+	}
+	if settings.RebootMessage, err = s.RebootMessage(); err != nil {
+		return settings, fmt.Errorf("could not retrieve reboot message: %v", err)
+	}
+	if settings.OnNonCrash, err = s.RecoveryActionsOnNonCrashFailures(); err != nil {
+		return settings, fmt.Errorf("could not retrieve recovery flag: %v", err)
+	}
+	return settings, nil
+}
+
+// RecoveryOnNonCrash reports whether the recovery actions of the installed
+// service also apply when it stops with a non-zero exit code.
+func (sw *ServiceWrapper) RecoveryOnNonCrash() (bool, error) {
+	var onNonCrash bool
+	err := sw.queryService(func(s *mgr.Service) error {
+		var err error
+		if onNonCrash, err = s.RecoveryActionsOnNonCrashFailures(); err != nil {
+			return fmt.Errorf("could not retrieve recovery flag: %v", err)
+		}
+		return nil
+	})
+	return onNonCrash, err
+}
@@ -0,0 +1,127 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+func TestRecoveryRoundTrip(t *testing.T) {
+	// The reboot action only fires if the service fails, and the test
+	// service is never started.
+	want := RecoverySettings{
+		Actions: []mgr.RecoveryAction{
+			{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+			{Type: mgr.RunCommand, Delay: 10 * time.Second},
+			{Type: mgr.ComputerReboot, Delay: time.Minute},
+		},
+		ResetPeriod:   24 * time.Hour,
+		Command:       `C:\Windows\System32\cmd.exe /c echo failed`,
+		RebootMessage: "svchelper test is rebooting the machine",
+		OnNonCrash:    true,
+	}
+	sw := installTestService(t,
+		WithRecoveryActions(want.Actions, want.ResetPeriod),
+		WithRecoveryCommand(want.Command),
+		WithRebootMessage(want.RebootMessage),
+		WithRecoveryOnNonCrash(want.OnNonCrash))
+	got, err := sw.RecoveryConfig()
+	if err != nil {
+		t.Fatalf("RecoveryConfig failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("RecoveryConfig() = %+v, want %+v", got, want)
+	}
+	drift, err := sw.ConfigDrift()
+	if err != nil {
+		t.Fatalf("ConfigDrift failed: %v", err)
+	}
+	if len(drift) > 0 {
+		t.Errorf("ConfigDrift() = %q right after the install, want none", drift)
+	}
+}
+
+func TestRecoveryDrift(t *testing.T) {
+	actions := []mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: 5 * time.Second}, {Type: mgr.RunCommand, Delay: time.Minute}}
+	installed := RecoverySettings{
+		Actions:       actions,
+		ResetPeriod:   time.Hour,
+		Command:       "notify.exe",
+		RebootMessage: "rebooting",
+		OnNonCrash:    true,
+	}
+	sw := newTestWrapper(t, idle,
+		WithRecoveryActions(actions, time.Hour),
+		WithRecoveryCommand("notify.exe"),
+		WithRebootMessage("rebooting"),
+		WithRecoveryOnNonCrash(true))
+	if drift := sw.recoveryDrift(installed); len(drift) > 0 {
+		t.Errorf("recoveryDrift of matching settings = %q, want none", drift)
+	}
+
+	got := RecoverySettings{
+		Actions:       actions[:1],
+		ResetPeriod:   2 * time.Hour,
+		Command:       "other.exe",
+		RebootMessage: "",
+		OnNonCrash:    false,
+	}
+	want := []string{
+		"recovery on non-crash failures",
+		"recovery actions",
+		"recovery reset period",
+		"recovery command",
+		"reboot message",
+	}
+	drift := sw.recoveryDrift(got)
+	if len(drift) != len(want) {
+		t.Fatalf("recoveryDrift = %q, want a difference for each of %q", drift, want)
+	}
+	for i, field := range want {
+		if !strings.HasPrefix(drift[i], field+" is ") {
+			t.Errorf("difference %d is %q, want one of the %s", i, drift[i], field)
+		}
+	}
+
+	// Settings the wrapper leaves alone are not compared.
+	bare := newTestWrapper(t, idle, WithRecoveryActions(actions, time.Hour))
+	if drift := bare.recoveryDrift(RecoverySettings{Actions: actions, ResetPeriod: time.Hour, Command: "x", RebootMessage: "y", OnNonCrash: true}); len(drift) > 0 {
+		t.Errorf("recoveryDrift compared unset settings: %q", drift)
+	}
+	flagOnly := newTestWrapper(t, idle, WithRecoveryOnNonCrash(true))
+	if drift := flagOnly.recoveryDrift(RecoverySettings{}); len(drift) != 1 {
+		t.Errorf("recoveryDrift with only the non-crash flag set = %q, want its difference alone", drift)
+	}
+}
+
+func TestValidateRecoveryActions(t *testing.T) {
+	tests := []struct {
+		desc    string
+		actions []mgr.RecoveryAction
+		wantErr bool
+	}{
+		{desc: "every type", actions: []mgr.RecoveryAction{{Type: mgr.NoAction}, {Type: mgr.ServiceRestart}, {Type: mgr.RunCommand}, {Type: mgr.ComputerReboot}}},
+		{desc: "none", wantErr: true},
+		{desc: "unknown type", actions: []mgr.RecoveryAction{{Type: 9}}, wantErr: true},
+		{desc: "negative delay", actions: []mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: -time.Second}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		err := validateRecoveryActions(tt.actions)
+		if tt.wantErr && err == nil {
+			t.Errorf("%s: validateRecoveryActions succeeded, want an error", tt.desc)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("%s: validateRecoveryActions failed: %v", tt.desc, err)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"unicode/utf16"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+const maxRegistryValueNameLength = 16383
+
+func (sw *ServiceWrapper) serviceKeyPath() string {
+	return `SYSTEM\CurrentControlSet\Services\` + sw.serviceName
+}
+
+// localMachine returns HKEY_LOCAL_MACHINE of the managed host. The returned
+// function releases the connection to a remote registry.
+func (sw *ServiceWrapper) localMachine() (registry.Key, func(), error) {
+	if sw.remoteHost == "" {
+		return registry.LOCAL_MACHINE, func() {}, nil
+	}
+	remote, err := registry.OpenRemoteKey(sw.remoteHost, registry.LOCAL_MACHINE)
+	if err != nil {
+		return 0, nil, fmt.Errorf("when connecting to the registry on %s: %w", sw.remoteHost, err)
+	}
+	return remote, func() { remote.Close() }, nil
+}
+
+func (sw *ServiceWrapper) openServiceKey(access uint32) (registry.Key, error) {
+	root, release, err := sw.localMachine()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	return registry.OpenKey(root, sw.serviceKeyPath(), access)
+}
+
+func validateRegistryValues(values map[string]any) error {
+	for name, value := range values {
+		if name == "" {
+			return fmt.Errorf("registry value name must not be empty")
+		}
+		if len(utf16.Encode([]rune(name))) > maxRegistryValueNameLength {
+			return fmt.Errorf("registry value name %.32q... exceeds %d characters", name, maxRegistryValueNameLength)
+		}
+		switch value.(type) {
+		case string, uint32, uint64, []byte:
+		default:
+			return fmt.Errorf("registry value %s has unsupported type %T, expected string, uint32, uint64 or []byte", name, value)
+		}
+	}
+	return nil
+}
+
+func (sw *ServiceWrapper) writeRegistryValues(values map[string]any) error {
+	k, err := sw.openServiceKey(registry.SET_VALUE)
+	if err != nil {
+		return fmt.Errorf("when opening the service registry key: %w", err)
+	}
+	defer k.Close()
+	return setRegistryValues(k, values)
+}
+
+// setRegistryValues writes values, as checked by validateRegistryValues,
+// under k in the order of their names.
+func setRegistryValues(k registry.Key, values map[string]any) error {
+	var err error
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch value := values[name].(type) {
+		case string:
+			err = k.SetStringValue(name, value)
+		case uint32:
+			err = k.SetDWordValue(name, value)
+		case uint64:
+			err = k.SetQWordValue(name, value)
+		case []byte:
+			err = k.SetBinaryValue(name, value)
+		}
+		if err != nil {
+			return fmt.Errorf("when writing registry value %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+const (
+	logLevelValueName  = "LogLevel"
+	startArgsValueName = "StartArgs"
+	runMarkerValueName = "RunInProgress"
+)
+
+func (sw *ServiceWrapper) parametersKeyPath() string {
+	return sw.serviceKeyPath() + `\Parameters`
+}
+
+func (sw *ServiceWrapper) readLogLevel() (string, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, sw.parametersKeyPath(), registry.QUERY_VALUE)
+	if err != nil {
+		return "", fmt.Errorf("when opening the service parameters: %w", err)
+	}
+	defer k.Close()
+	level, _, err := k.GetStringValue(logLevelValueName)
+	if err != nil {
+		return "", fmt.Errorf("when reading %s: %w", logLevelValueName, err)
+	}
+	return level, nil
+}
+
+func (sw *ServiceWrapper) writeLogLevel(level string) error {
+	root, release, err := sw.localMachine()
+	if err != nil {
+		return err
+	}
+	defer release()
+	k, _, err := registry.CreateKey(root, sw.parametersKeyPath(), registry.SET_VALUE)
+	if err != nil {
+		return fmt.Errorf("when creating the service parameters: %w", err)
+	}
+	defer k.Close()
+	if err := k.SetStringValue(logLevelValueName, level); err != nil {
+		return fmt.Errorf("when writing %s: %w", logLevelValueName, err)
+	}
+	return nil
+}
+
+// StartArgs returns the start arguments set by WithStartArgs at install, or
+// nil if there are none. The SCM does not persist the arguments passed when
+// starting a service, and starts automatic services without any, so they
+// are kept as the StartArgs value under the Parameters key instead; a run
+// started without arguments receives these through ArgsReceiver.
+func (sw *ServiceWrapper) StartArgs() ([]string, error) {
+	root, release, err := sw.localMachine()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	k, err := registry.OpenKey(root, sw.parametersKeyPath(), registry.QUERY_VALUE)
+	if errors.Is(err, registry.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("when opening the service parameters: %w", err)
+	}
+	defer k.Close()
+	args, _, err := k.GetStringsValue(startArgsValueName)
+	if errors.Is(err, registry.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("when reading %s: %w", startArgsValueName, err)
+	}
+	return args, nil
+}
+
+func (sw *ServiceWrapper) writeStartArgs(args []string) error {
+	root, release, err := sw.localMachine()
+	if err != nil {
+		return err
+	}
+	defer release()
+	k, _, err := registry.CreateKey(root, sw.parametersKeyPath(), registry.SET_VALUE)
+	if err != nil {
+		return fmt.Errorf("when creating the service parameters: %w", err)
+	}
+	defer k.Close()
+	if err := k.SetStringsValue(startArgsValueName, args); err != nil {
+		return fmt.Errorf("when writing %s: %w", startArgsValueName, err)
+	}
+	return nil
+}
+
+// markRunStarted records under the Parameters key that a run under the SCM
+// is in progress, and reports whether the marker of an earlier run was
+// still there, meaning that run did not stop cleanly. marked is false when
+// the marker could not be written.
+func (sw *ServiceWrapper) markRunStarted() (unclean, marked bool) {
+	k, _, err := registry.CreateKey(registry.LOCAL_MACHINE, sw.parametersKeyPath(), registry.QUERY_VALUE|registry.SET_VALUE)
+	if err != nil {
+		elog.Warning(1, fmt.Sprintf("When opening the parameters of the service '%s': %s", sw.serviceName, err))
+		return false, false
+	}
+	defer k.Close()
+	_, _, err = k.GetIntegerValue(runMarkerValueName)
+	unclean = err == nil
+	if err := k.SetDWordValue(runMarkerValueName, 1); err != nil {
+		elog.Warning(1, fmt.Sprintf("When writing %s of the service '%s': %s", runMarkerValueName, sw.serviceName, err))
+		return unclean, false
+	}
+	return unclean, true
+}
+
+// clearRunMarker removes the marker of markRunStarted once the run stopped
+// cleanly.
+func (sw *ServiceWrapper) clearRunMarker() {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, sw.parametersKeyPath(), registry.SET_VALUE)
+	if err == nil {
+		err = k.DeleteValue(runMarkerValueName)
+		k.Close()
+	}
+	if err != nil {
+		elog.Warning(1, fmt.Sprintf("When removing %s of the service '%s': %s", runMarkerValueName, sw.serviceName, err))
+	}
+}
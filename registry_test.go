@@ -0,0 +1,99 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+func TestValidateRegistryValues(t *testing.T) {
+	tests := []struct {
+		desc    string
+		values  map[string]any
+		wantErr bool
+	}{
+		{desc: "nil map", values: nil},
+		{desc: "supported types", values: map[string]any{
+			"Name":    "value",
+			"DWord":   uint32(1),
+			"QWord":   uint64(1 << 40),
+			"Binary":  []byte{1, 2, 3},
+			"Unicode": "ünïcödé",
+		}},
+		{desc: "longest name", values: map[string]any{strings.Repeat("n", maxRegistryValueNameLength): "v"}},
+		{desc: "empty name", values: map[string]any{"": "v"}, wantErr: true},
+		{desc: "longest non-ASCII name", values: map[string]any{strings.Repeat("ü", maxRegistryValueNameLength): "v"}},
+		{desc: "name too long", values: map[string]any{strings.Repeat("n", maxRegistryValueNameLength+1): "v"}, wantErr: true},
+		{desc: "int", values: map[string]any{"Int": 1}, wantErr: true},
+		{desc: "int32", values: map[string]any{"Int32": int32(1)}, wantErr: true},
+		{desc: "bool", values: map[string]any{"Bool": true}, wantErr: true},
+		{desc: "strings", values: map[string]any{"Strings": []string{"a"}}, wantErr: true},
+		{desc: "nil value", values: map[string]any{"Nil": nil}, wantErr: true},
+	}
+	for _, tt := range tests {
+		err := validateRegistryValues(tt.values)
+		if tt.wantErr && err == nil {
+			t.Errorf("%s: validateRegistryValues succeeded, want an error", tt.desc)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("%s: validateRegistryValues failed: %v", tt.desc, err)
+		}
+	}
+}
+
+// testKey creates a registry key for the test under HKEY_CURRENT_USER,
+// which needs no elevation, and deletes it when the test ends.
+func testKey(t *testing.T) registry.Key {
+	t.Helper()
+	path := `Software\svchelper-test\` + t.Name()
+	k, _, err := registry.CreateKey(registry.CURRENT_USER, path, registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("could not create the test key: %v", err)
+	}
+	t.Cleanup(func() {
+		k.Close()
+		registry.DeleteKey(registry.CURRENT_USER, path)
+		registry.DeleteKey(registry.CURRENT_USER, `Software\svchelper-test`)
+	})
+	return k
+}
+
+func TestRegistryValuesRoundTrip(t *testing.T) {
+	k := testKey(t)
+	values := map[string]any{
+		"Name":    "value",
+		"Unicode": "ünïcödé",
+		"DWord":   uint32(7),
+		"QWord":   uint64(1 << 40),
+		"Binary":  []byte{1, 2, 3},
+	}
+	if err := validateRegistryValues(values); err != nil {
+		t.Fatalf("validateRegistryValues failed: %v", err)
+	}
+	if err := setRegistryValues(k, values); err != nil {
+		t.Fatalf("setRegistryValues failed: %v", err)
+	}
+	got, err := readRegistryValues(k)
+	if err != nil {
+		t.Fatalf("readRegistryValues failed: %v", err)
+	}
+	want := map[string]registryValue{
+		"Name":    {registry.SZ, "value"},
+		"Unicode": {registry.SZ, "ünïcödé"},
+		"DWord":   {registry.DWORD, uint64(7)},
+		"QWord":   {registry.QWORD, uint64(1 << 40)},
+		"Binary":  {registry.BINARY, []byte{1, 2, 3}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("read back %v, want %v", got, want)
+	}
+}
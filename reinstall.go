@@ -0,0 +1,242 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const reinstallRemoveTimeout = 30 * time.Second
+
+// serviceSnapshot holds the settings of an installed service that a plain
+// remove and install would lose.
+type serviceSnapshot struct {
+	config           mgr.Config
+	recoveryActions  []mgr.RecoveryAction
+	resetPeriod      uint32
+	rebootMessage    string
+	recoveryCommand  string
+	recoveryNonCrash bool
+	triggers         []byte
+	parameters       map[string]registryValue
+}
+
+type registryValue struct {
+	valtype uint32
+	value   any
+}
+
+func (sw *ServiceWrapper) snapshot(s *mgr.Service) (*serviceSnapshot, error) {
+	snap := &serviceSnapshot{}
+	var err error
+	if snap.config, err = s.Config(); err != nil {
+		return nil, fmt.Errorf("could not retrieve service config: %v", err)
+	}
+	if snap.recoveryActions, err = s.RecoveryActions(); err != nil {
+		return nil, fmt.Errorf("could not retrieve recovery actions: %v", err)
+	}
+	if snap.resetPeriod, err = s.ResetPeriod(); err != nil {
+		return nil, fmt.Errorf("could not retrieve recovery reset period: %v", err)
+	}
+	if snap.rebootMessage, err = s.RebootMessage(); err != nil {
+		return nil, fmt.Errorf("could not retrieve reboot message: %v", err)
+	}
+	if snap.recoveryCommand, err = s.RecoveryCommand(); err != nil {
+		return nil, fmt.Errorf("could not retrieve recovery command: %v", err)
+	}
+	if snap.recoveryNonCrash, err = s.RecoveryActionsOnNonCrashFailures(); err != nil {
+		return nil, fmt.Errorf("could not retrieve recovery flag: %v", err)
+	}
+	if snap.triggers, err = queryServiceConfig2(s, windows.SERVICE_CONFIG_TRIGGER_INFO); err != nil {
+		return nil, fmt.Errorf("could not retrieve triggers: %v", err)
+	}
+	if snap.parameters, err = sw.readParameters(); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+func (sw *ServiceWrapper) restore(s *mgr.Service, snap *serviceSnapshot) error {
+	installed, err := s.Config()
+	if err != nil {
+		return fmt.Errorf("could not retrieve service config: %v", err)
+	}
+	config := snap.config
+	config.BinaryPathName = installed.BinaryPathName
+	config.Password = ""
+	if err := s.UpdateConfig(config); err != nil {
+		return fmt.Errorf("could not restore service config: %v", err)
+	}
+	if len(snap.recoveryActions) > 0 {
+		if err := setRecoveryActions(s, snap.recoveryActions, snap.resetPeriod); err != nil {
+			return fmt.Errorf("could not restore recovery actions: %v", err)
+		}
+	}
+	if err := s.SetRebootMessage(snap.rebootMessage); err != nil {
+		return fmt.Errorf("could not restore reboot message: %v", err)
+	}
+	if err := s.SetRecoveryCommand(snap.recoveryCommand); err != nil {
+		return fmt.Errorf("could not restore recovery command: %v", err)
+	}
+	if err := s.SetRecoveryActionsOnNonCrashFailures(snap.recoveryNonCrash); err != nil {
+		return fmt.Errorf("could not restore recovery flag: %v", err)
+	}
+	if err := windows.ChangeServiceConfig2(s.Handle, windows.SERVICE_CONFIG_TRIGGER_INFO, &snap.triggers[0]); err != nil {
+		return fmt.Errorf("could not restore triggers: %v", err)
+	}
+	return sw.writeParameters(snap.parameters)
+}
+
+// Reinstall removes and installs the service again, pointing it at the
+// current executable path while keeping the config, recovery actions,
+// triggers and Parameters values of the installed service. This supports
+// in-place binary upgrades without losing operator customizations. The
+// password of an account changed out of band cannot be read back and is
+// not restored. A running service is stopped first, as the SCM only
+// deletes a stopped one, and started again once the settings are restored.
+func (sw *ServiceWrapper) Reinstall() error {
+	var snap *serviceSnapshot
+	var wasRunning bool
+	err := sw.withService(func(s *mgr.Service) error {
+		status, err := s.Query()
+		if err != nil {
+			return fmt.Errorf("could not retrieve service status: %v", err)
+		}
+		wasRunning = status.State != svc.Stopped
+		snap, err = sw.snapshot(s)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("when taking a snapshot: %w", err)
+	}
+	ctx := context.Background()
+	if wasRunning {
+		if err := sw.controlService(ctx, sw.serviceName, svc.Stop, []svc.State{svc.Stopped}); err != nil {
+			return fmt.Errorf("when stopping the service before reinstalling: %w", err)
+		}
+	}
+	if err := sw.RemoveService(); err != nil {
+		return err
+	}
+	if err := sw.WaitRemoved(reinstallRemoveTimeout); err != nil {
+		return err
+	}
+	if err := sw.InstallService(); err != nil {
+		return err
+	}
+	err = sw.withService(func(s *mgr.Service) error {
+		return sw.restore(s, snap)
+	})
+	if err != nil {
+		return fmt.Errorf("when restoring the snapshot: %w", err)
+	}
+	if wasRunning {
+		ctx, cancel := context.WithTimeout(ctx, reinstallRemoveTimeout)
+		defer cancel()
+		if err := sw.startService(ctx, sw.serviceName, true); err != nil {
+			return fmt.Errorf("when starting the reinstalled service: %w", err)
+		}
+	}
+	return nil
+}
+
+// readParameters reads the values directly under the Parameters key of the
+// service; subkeys are not included.
+func (sw *ServiceWrapper) readParameters() (map[string]registryValue, error) {
+	root, release, err := sw.localMachine()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	k, err := registry.OpenKey(root, sw.parametersKeyPath(), registry.QUERY_VALUE)
+	if errors.Is(err, registry.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("when opening the service parameters: %w", err)
+	}
+	defer k.Close()
+	return readRegistryValues(k)
+}
+
+// readRegistryValues reads the values directly under k with their types.
+// Integer values are read as uint64 and values of other types as binary.
+func readRegistryValues(k registry.Key) (map[string]registryValue, error) {
+	names, err := k.ReadValueNames(0)
+	if err != nil {
+		return nil, fmt.Errorf("when listing the registry values: %w", err)
+	}
+	values := make(map[string]registryValue, len(names))
+	for _, name := range names {
+		_, valtype, err := k.GetValue(name, nil)
+		if err != nil {
+			return nil, fmt.Errorf("when reading registry value %s: %w", name, err)
+		}
+		var value any
+		switch valtype {
+		case registry.SZ, registry.EXPAND_SZ:
+			value, _, err = k.GetStringValue(name)
+		case registry.MULTI_SZ:
+			value, _, err = k.GetStringsValue(name)
+		case registry.DWORD, registry.QWORD:
+			value, _, err = k.GetIntegerValue(name)
+		default:
+			value, _, err = k.GetBinaryValue(name)
+			valtype = registry.BINARY
+		}
+		if err != nil {
+			return nil, fmt.Errorf("when reading registry value %s: %w", name, err)
+		}
+		values[name] = registryValue{valtype: valtype, value: value}
+	}
+	return values, nil
+}
+
+func (sw *ServiceWrapper) writeParameters(values map[string]registryValue) error {
+	if len(values) == 0 {
+		return nil
+	}
+	root, release, err := sw.localMachine()
+	if err != nil {
+		return err
+	}
+	defer release()
+	k, _, err := registry.CreateKey(root, sw.parametersKeyPath(), registry.SET_VALUE)
+	if err != nil {
+		return fmt.Errorf("when creating the service parameters: %w", err)
+	}
+	defer k.Close()
+	for name, v := range values {
+		switch v.valtype {
+		case registry.SZ:
+			err = k.SetStringValue(name, v.value.(string))
+		case registry.EXPAND_SZ:
+			err = k.SetExpandStringValue(name, v.value.(string))
+		case registry.MULTI_SZ:
+			err = k.SetStringsValue(name, v.value.([]string))
+		case registry.DWORD:
+			err = k.SetDWordValue(name, uint32(v.value.(uint64)))
+		case registry.QWORD:
+			err = k.SetQWordValue(name, v.value.(uint64))
+		default:
+			err = k.SetBinaryValue(name, v.value.([]byte))
+		}
+		if err != nil {
+			return fmt.Errorf("when writing parameter %s: %w", name, err)
+		}
+	}
+	return nil
+}
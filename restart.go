@@ -0,0 +1,85 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+const (
+	// restartAttemptArg is the start argument, followed by the attempt,
+	// the service is started again with under the SCM.
+	restartAttemptArg = "--svchelper-restart-attempt"
+	// restartAttemptEnv holds the attempt in the environment of the
+	// executable a debug run starts again.
+	restartAttemptEnv = "SVCHELPER_RESTART_ATTEMPT"
+)
+
+// runRestarted runs the executable a debug run starts again; tests replace
+// it.
+var runRestarted = (*exec.Cmd).Run
+
+// restart starts the service again after a fatal error, see
+// WithRestartOnFatal. It runs once the failed run has released everything,
+// including its single-instance mutex.
+func (sw *ServiceWrapper) restart(isDebug bool) error {
+	attempt := sw.restartAttempt(isDebug) + 1
+	if attempt > sw.maxRestarts {
+		return fmt.Errorf("%s failed again after %d restarts, not restarting it", sw.serviceName, sw.maxRestarts)
+	}
+	time.Sleep(sw.restartDelay)
+	if !isDebug {
+		args := []string{restartAttemptArg, strconv.Itoa(attempt)}
+		if err := sw.startServiceWithArgs(context.Background(), sw.serviceName, args, false); err != nil {
+			return fmt.Errorf("when restarting after a fatal error: %w", err)
+		}
+		return nil
+	}
+	executablePath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("when getting executable path: %s", err)
+	}
+	fmt.Fprintf(os.Stderr, "%s failed, starting it again (attempt %d of %d)\n", sw.serviceName, attempt, sw.maxRestarts)
+	cmd := exec.Command(executablePath, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), restartAttemptEnv+"="+strconv.Itoa(attempt))
+	return runRestarted(cmd)
+}
+
+// restartAttempt returns how often the service has been restarted in a row
+// before the current run, 0 for a run that was not started by restart.
+func (sw *ServiceWrapper) restartAttempt(isDebug bool) int {
+	if isDebug {
+		attempt, _ := strconv.Atoi(os.Getenv(restartAttemptEnv))
+		return attempt
+	}
+	sw.runMu.Lock()
+	defer sw.runMu.Unlock()
+	return sw.runRestartAttempt
+}
+
+// stripRestartAttempt records and removes the restart attempt from the
+// arguments passed to Execute by a start through restart.
+func (sw *ServiceWrapper) stripRestartAttempt(args []string) []string {
+	if len(args) != 3 || args[1] != restartAttemptArg {
+		return args
+	}
+	attempt, err := strconv.Atoi(args[2])
+	if err != nil {
+		return args
+	}
+	sw.runMu.Lock()
+	sw.runRestartAttempt = attempt
+	sw.runMu.Unlock()
+	return args[:1]
+}
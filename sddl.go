@@ -0,0 +1,71 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+var procSetServiceObjectSecurity = modadvapi32.NewProc("SetServiceObjectSecurity")
+
+// parseServiceSDDL parses sddl and checks that it carries a DACL, the only
+// part of it that is applied to the service.
+func parseServiceSDDL(sddl string) (*windows.SECURITY_DESCRIPTOR, error) {
+	sd, err := windows.SecurityDescriptorFromString(sddl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SDDL '%s': %w", sddl, err)
+	}
+	if dacl, _, err := sd.DACL(); err != nil || dacl == nil {
+		return nil, fmt.Errorf("SDDL '%s' has no DACL", sddl)
+	}
+	return sd, nil
+}
+
+// setServiceSDDL replaces the DACL of the service with the one in sddl. The
+// handle needs WRITE_DAC, which the handles of withService have.
+func setServiceSDDL(s *mgr.Service, sddl string) error {
+	sd, err := parseServiceSDDL(sddl)
+	if err != nil {
+		return err
+	}
+	r, _, e := procSetServiceObjectSecurity.Call(uintptr(s.Handle), uintptr(windows.DACL_SECURITY_INFORMATION), uintptr(unsafe.Pointer(sd)))
+	if r == 0 {
+		return fmt.Errorf("SetServiceObjectSecurity() failed: %v", e)
+	}
+	return nil
+}
+
+// ServiceSDDL returns the DACL of the installed service in SDDL form, e.g.
+// to check the result of WithServiceSDDL. Reading it needs READ_CONTROL on
+// the service, which the default DACL grants to interactive users.
+func (sw *ServiceWrapper) ServiceSDDL() (string, error) {
+	m, err := sw.connectReadOnly()
+	if err != nil {
+		return "", err
+	}
+	defer m.Disconnect()
+	h, err := windows.OpenService(m.Handle, syscall.StringToUTF16Ptr(sw.serviceName), windows.READ_CONTROL)
+	if errors.Is(err, windows.ERROR_SERVICE_DOES_NOT_EXIST) {
+		return "", fmt.Errorf("%s: %w", sw.serviceName, ErrNotInstalled)
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not access service: %v", err)
+	}
+	defer windows.CloseServiceHandle(h)
+	sd, err := windows.GetSecurityInfo(h, windows.SE_SERVICE, windows.DACL_SECURITY_INFORMATION)
+	if err != nil {
+		return "", fmt.Errorf("could not query service security: %v", err)
+	}
+	return sd.String(), nil
+}
@@ -0,0 +1,44 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// selfTestTimeout bounds the "selftest" command.
+const selfTestTimeout = 2 * time.Minute
+
+// SelfTester can optionally be implemented by a Service to provide checks,
+// such as connectivity or configuration tests, that operators run with the
+// "selftest" command after installing it. SelfTest runs in the management
+// process, not under the SCM, and should return once ctx is done.
+type SelfTester interface {
+	SelfTest(ctx context.Context) error
+}
+
+// runSelfTest runs the self-test of the service, printing its progress and
+// result, and returns an error if it fails.
+func (sw *ServiceWrapper) runSelfTest(ctx context.Context) error {
+	tester, ok := sw.service.(SelfTester)
+	if !ok {
+		return fmt.Errorf("the service does not implement a self-test")
+	}
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+	fmt.Printf("running the self-test of %s\n", sw.serviceName)
+	start := time.Now()
+	if err := tester.SelfTest(ctx); err != nil {
+		fmt.Printf("FAIL: %s (%s)\n", err, time.Since(start).Round(time.Millisecond))
+		return fmt.Errorf("self-test failed: %w", err)
+	}
+	fmt.Printf("PASS (%s)\n", time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfTesting is a SelfTester returning err and recording the deadline of
+// its context.
+type selfTesting struct {
+	Service
+	err      error
+	deadline time.Time
+}
+
+func (s *selfTesting) SelfTest(ctx context.Context) error {
+	s.deadline, _ = ctx.Deadline()
+	return s.err
+}
+
+// captureStdout returns what f prints to os.Stdout.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	printed := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		printed <- string(b)
+	}()
+	f()
+	w.Close()
+	return <-printed
+}
+
+// manage runs ManageService with the command line arguments args.
+func manage(sw *ServiceWrapper, args ...string) error {
+	saved := os.Args
+	defer func() { os.Args = saved }()
+	os.Args = append([]string{saved[0]}, args...)
+	return sw.ManageService()
+}
+
+func TestSelfTestCommand(t *testing.T) {
+	broken := errors.New("database unreachable")
+	tests := []struct {
+		desc       string
+		service    Service
+		wantErr    error
+		wantOutput string
+	}{
+		{desc: "pass", service: &selfTesting{Service: idle}, wantOutput: "PASS"},
+		{desc: "fail", service: &selfTesting{Service: idle, err: broken}, wantErr: broken, wantOutput: "FAIL: database unreachable"},
+		{desc: "no self-test", service: idle},
+	}
+	for _, tt := range tests {
+		sw := newTestWrapper(t, tt.service)
+		var err error
+		begin := time.Now()
+		output := captureStdout(t, func() { err = manage(sw, "selftest") })
+		// ManageService returning an error is what makes the host exit
+		// with a non-zero code.
+		switch {
+		case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+			t.Errorf("%s: ManageService returned %v, want the self-test error", tt.desc, err)
+		case tt.wantErr == nil && tt.wantOutput != "" && err != nil:
+			t.Errorf("%s: ManageService returned %v for a passing self-test", tt.desc, err)
+		case tt.wantOutput == "" && err == nil:
+			t.Errorf("%s: ManageService succeeded for a service without a self-test", tt.desc)
+		}
+		if !strings.Contains(output, tt.wantOutput) {
+			t.Errorf("%s: the self-test printed %q, want %q", tt.desc, output, tt.wantOutput)
+		}
+		if tester, ok := tt.service.(*selfTesting); ok {
+			if tester.deadline.IsZero() || tester.deadline.After(begin.Add(selfTestTimeout+time.Second)) {
+				t.Errorf("%s: the self-test ran with deadline %s, want one within %s", tt.desc, tester.deadline, selfTestTimeout)
+			}
+		}
+	}
+}
+
+func TestSelfTestHandler(t *testing.T) {
+	handler := commandHandler("selftest")
+	if handler == nil {
+		t.Fatal("there is no handler for the selftest command")
+	}
+	// The handler passes on the context of the management command.
+	tester := &selfTesting{Service: idle}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	want, _ := ctx.Deadline()
+	captureStdout(t, func() {
+		if err := handler(newTestWrapper(t, tester), ctx, []string{"selftest"}); err != nil {
+			t.Errorf("the selftest handler failed: %v", err)
+		}
+	})
+	if !tester.deadline.Equal(want) {
+		t.Errorf("the self-test ran with deadline %s, want the one of the command %s", tester.deadline, want)
+	}
+}
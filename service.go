@@ -9,45 +9,252 @@ package svchelper
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/svc"
 	"golang.org/x/sys/windows/svc/debug"
-	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
 )
 
-var elog debug.Log
+// elog discards messages until RunService opens a log, so Execute can also
+// be driven directly, e.g. from tests.
+var elog debug.Log = nopLog{}
 
 type Service interface {
 	Schedule(ctx context.Context, wg *sync.WaitGroup, cancel context.CancelFunc) error
 }
 
+// Readier can optionally be implemented by a Service that keeps initializing
+// after Schedule returns. The returned channel is closed once the service is
+// accepting work, and only then is the service reported as running.
+type Readier interface {
+	Ready() <-chan struct{}
+}
+
+// ExitErrorer can optionally be implemented by a Service that cancels itself.
+// A non-nil ExitError after such a cancellation is treated as a fatal
+// condition and the service exits with a non-zero code, so that the SCM
+// recovery actions can kick in.
+type ExitErrorer interface {
+	ExitError() error
+}
+
+// ControlSetLogLevel is the custom control code making a running service
+// re-read the LogLevel value under its Parameters registry key and pass it to
+// the LogLevelSetter. SetLogLevel writes the value and sends the control.
+const ControlSetLogLevel = svc.Cmd(128)
+
+// LogLevelSetter can optionally be implemented by a Service to have its log
+// level changed at runtime through ControlSetLogLevel.
+type LogLevelSetter interface {
+	SetLevel(level string) error
+}
+
+// StopErrorReporter can optionally be implemented by a Service to report
+// errors from its shutdown path, such as failing to flush data. It is
+// called once all goroutines of the service have returned; a non-nil error
+// is logged and makes the service exit with a non-zero code.
+type StopErrorReporter interface {
+	StopError() error
+}
+
+// Pauser can optionally be implemented by a Service to support the pause
+// and continue controls. The service is reported as Paused once Pause
+// returns and as Running once Continue returns; an error leaves the state
+// unchanged.
+type Pauser interface {
+	Pause() error
+	Continue() error
+}
+
+// ArgsReceiver can optionally be implemented by a Service to receive its
+// start arguments before Schedule is called. Under the SCM these are the
+// arguments given when starting the service, without the service name; for
+// "debug" runs they are the arguments following the debug command, in order.
+type ArgsReceiver interface {
+	SetArgs(args []string)
+}
+
+// argsKey is the context key of the start arguments.
+type argsKey struct{}
+
+// ArgsFromContext returns the start arguments of the run when ctx is the
+// context passed to Schedule or derived from it, and nil otherwise. They are
+// the arguments ArgsReceiver receives; implementing that interface instead
+// hands them over before Schedule is called.
+func ArgsFromContext(ctx context.Context) []string {
+	args, _ := ctx.Value(argsKey{}).([]string)
+	return args
+}
+
+// RunMode tells how the service was run.
+type RunMode int
+
+const (
+	RunModeNone       RunMode = iota // the service was not run
+	RunModeService                   // under the SCM, through svc.Run
+	RunModeDebug                     // in the console, through debug.Run
+	RunModeForeground                // by RunForeground, without the SCM
+)
+
+func (m RunMode) String() string {
+	switch m {
+	case RunModeNone:
+		return "none"
+	case RunModeService:
+		return "service"
+	case RunModeDebug:
+		return "debug"
+	case RunModeForeground:
+		return "foreground"
+	}
+	return fmt.Sprintf("RunMode(%d)", int(m))
+}
+
 type ServiceWrapper struct {
 	service                      Service
 	serviceName                  string
 	serviceDisplayName           string
 	serviceDescription           string
+	descriptionSource            func() (string, error)
 	useExePathAsWorkingDirectory bool
+	readyTimeout                 time.Duration
+	serviceNameOverridden        bool
+	registryValues               map[string]any
+	eventLogTimeout              time.Duration
+	serviceAccount               string
+	servicePassword              string
+	virtualAccount               bool
+	passwordSource               func() ([]byte, error)
+	interactive                  bool
+	grantLogonRight              bool
+	skipEventSource              bool
+	exitWhenScheduleReturns      bool
+	remoteHost                   string
+	pollInterval                 time.Duration
+	maxPollInterval              time.Duration
+	waitStrategy                 WaitStrategy
+	powerPolicy                  PowerPolicy
+	startType                    uint32
+	dependencies                 []string
+	interrogateDelay             time.Duration
+	stopTimeout                  time.Duration
+	gracefulStopDelay            time.Duration
+	restartOnFatal               bool
+	maxRestarts                  int
+	restartDelay                 time.Duration
+	interceptor                  ChangeRequestInterceptor
+	parameters                   any
+	lockOSThread                 bool
+	comModel                     COMModel
+	verifyBinary                 bool
+	auditLogPath                 string
+	preshutdownTimeout           time.Duration
+	configValidator              func(mgr.Config) error
+	serviceType                  uint32
+	driverPath                   string
+	exePathResolver              func() (string, error)
+	statusObserver               func(svc.Status)
+	preInstall                   InstallHook
+	postInstall                  InstallHook
+	preRemove                    RemoveHook
+	postRemove                   RemoveHook
+	commandAliases               map[string]string
+	healthAddr                   string
+	livenessPath                 string
+	livenessInterval             time.Duration
+	etwProvider                  *windows.GUID
+	instanceMutex                string
+	recovery                     RecoverySettings
+	recoveryNonCrashSet          bool
+	requiredPrivileges           []string
+	sidType                      uint32
+	serviceSDDL                  string
+	eventMessageFile             string
+	running                      atomic.Bool // guards against concurrent runs
+	runMu                        sync.Mutex
+	runCtx                       context.Context
+	runStatus                    *statusReporter
+	runMode                      RunMode
+	runFatal                     bool
+	runRestartAttempt            int
+	debugArgs                    []string
+	installStartArgs             []string
+	jsonOutput                   bool
+	managementTimeout            time.Duration
+	closeMu                      sync.Mutex
+	closers                      []func() error
 }
 
-func GetServiceWrapper(service Service, servicName, serviceDisplayName, serviceDescription string, useExePathAsWorkingDirectory bool) (*ServiceWrapper, error) {
-	if useExePathAsWorkingDirectory {
-		if err := setExePathAsWorkingDirectory(); err != nil {
-			return nil, fmt.Errorf("when changing working directory: %s", err)
-		}
+func GetServiceWrapper(service Service, servicName, serviceDisplayName, serviceDescription string, useExePathAsWorkingDirectory bool, opts ...Option) (*ServiceWrapper, error) {
+	servicName, err := normalizeServiceName(servicName)
+	if err != nil {
+		return nil, fmt.Errorf("when validating the service name: %w", err)
 	}
-	return &ServiceWrapper{
+	sw := &ServiceWrapper{
 		service:                      service,
 		serviceName:                  servicName,
 		serviceDisplayName:           serviceDisplayName,
 		serviceDescription:           serviceDescription,
 		useExePathAsWorkingDirectory: useExePathAsWorkingDirectory,
-	}, nil
+		readyTimeout:                 defaultReadyTimeout,
+		eventLogTimeout:              defaultEventLogTimeout,
+		pollInterval:                 defaultPollInterval,
+		maxPollInterval:              defaultMaxPollInterval,
+		maxRestarts:                  defaultMaxRestarts,
+		restartDelay:                 defaultRestartDelay,
+		startType:                    mgr.StartAutomatic,
+		serviceType:                  windows.SERVICE_WIN32_OWN_PROCESS,
+	}
+	for _, opt := range opts {
+		if err := opt(sw); err != nil {
+			return nil, fmt.Errorf("when applying option: %w", err)
+		}
+	}
+	if err := sw.validate(); err != nil {
+		return nil, fmt.Errorf("when validating options: %w", err)
+	}
+	if useExePathAsWorkingDirectory {
+		if err := setExePathAsWorkingDirectory(); err != nil {
+			return nil, fmt.Errorf("when changing working directory: %s", err)
+		}
+	}
+	return sw, nil
+}
+
+// ResolvePath returns path resolved against the directory of the executable
+// if it is relative. Services started by the SCM run in the system
+// directory; resolving their config and data paths with ResolvePath is the
+// alternative to the useExePathAsWorkingDirectory flag of GetServiceWrapper
+// that leaves the working directory alone, which is preferable when
+// libraries cache it or other relative paths must keep working. If the
+// executable cannot be determined, path is returned unchanged.
+func ResolvePath(path string) string {
+	resolved, err := resolvePath(path)
+	if err != nil {
+		return path
+	}
+	return resolved
+}
+
+func resolvePath(path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return path, nil
+	}
+	executablePath, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("when getting executable path: %s", err)
+	}
+	return filepath.Join(filepath.Dir(executablePath), path), nil
 }
 
 func setExePathAsWorkingDirectory() error {
@@ -63,63 +270,471 @@ func setExePathAsWorkingDirectory() error {
 }
 
 func (sw *ServiceWrapper) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (ssec bool, errno uint32) {
-	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown // | svc.AcceptPauseAndContinue
-	changes <- svc.Status{State: svc.StartPending}
-	ctx, cancel := context.WithCancel(context.Background())
+	if sw.lockOSThread || sw.comModel != COMNone {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+	}
+	cmdsAccepted := sw.AcceptedCommands()
+	status := newStatusReporter(changes, sw.statusObserver)
+	status.report(svc.Status{State: svc.StartPending})
+	if sw.comModel != COMNone {
+		uninit, err := initCOM(sw.comModel)
+		if err != nil {
+			elog.Error(1, fmt.Sprintf("When initializing COM for the service '%s': %s", sw.serviceName, err))
+			status.finish(svc.Status{State: svc.StopPending})
+			return false, 1
+		}
+		defer uninit()
+	}
+	startArgs := sw.startArgs(args)
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), argsKey{}, startArgs))
+	sw.setRunContext(ctx, status)
+	defer sw.setRunContext(nil, nil)
 	wg := &sync.WaitGroup{}
-	if err := sw.service.Schedule(ctx, wg, cancel); err != nil {
-		elog.Error(1, fmt.Sprintf("When scheduling the service '%s': %s", sw.serviceName, err))
+	stop := newStopSequence(sw, wg, status)
+	var recoveryStart, marked bool
+	if sw.LastRunMode() == RunModeService {
+		recoveryStart, marked = sw.markRunStarted()
+	}
+	// Whichever way Execute returns, the service is shut down, cancelled
+	// and every goroutine it added to wg is joined first.
+	defer func() {
+		defer stop.finish()
+		stop.shutdown()
 		cancel()
-		wg.Wait()
+		stop.join()
+		if reporter, ok := sw.service.(StopErrorReporter); ok {
+			if err := reporter.StopError(); err != nil {
+				elog.Error(1, fmt.Sprintf("When stopping the service '%s': %s", sw.serviceName, err))
+				if errno == 0 {
+					ssec, errno = exitCode(err)
+				}
+			}
+		}
+		if marked && errno == 0 {
+			sw.clearRunMarker()
+		}
+		status.finish(svc.Status{State: svc.StopPending})
+	}()
+	if receiver, ok := sw.service.(ArgsReceiver); ok {
+		receiver.SetArgs(startArgs)
+	}
+	lifecycle := newLifecycle(ctx, status)
+	lifecycle.recoveryStart = recoveryStart
+	if sw.parameters != nil {
+		if err := sw.LoadParameters(sw.parameters); err != nil {
+			elog.Error(1, fmt.Sprintf("When loading the parameters of the service '%s': %s", sw.serviceName, err))
+			errno = 1
+			return
+		}
+		lifecycle.params = sw.parameters
+	}
+	if aware, ok := sw.service.(LifecycleAware); ok {
+		aware.SetLifecycle(lifecycle)
+	}
+	if sw.healthAddr != "" {
+		if err := sw.startHealthEndpoint(ctx, wg); err != nil {
+			elog.Error(1, fmt.Sprintf("When starting the service '%s': %s", sw.serviceName, err))
+			errno = 1
+			return
+		}
+	}
+	if sw.mustStopForPower() {
+		elog.Info(1, fmt.Sprintf("The service '%s' only runs on AC power and is stopped", sw.serviceName))
+		return
+	}
+	// Accepting a stop while starting lets the SCM deliver it to the
+	// startup watcher instead of refusing it until Schedule returns.
+	status.report(svc.Status{State: svc.StartPending, Accepts: svc.AcceptStop | svc.AcceptShutdown})
+	stop.arm()
+	startup := sw.watchStartup(r, status, stop, cancel)
+	err := sw.service.Schedule(ctx, wg, cancel)
+	var readyErr error
+	if err == nil && !sw.exitWhenScheduleReturns {
+		if readier, ok := sw.service.(Readier); ok {
+			status.report(svc.Status{State: svc.StartPending, Accepts: svc.AcceptStop | svc.AcceptShutdown, WaitHint: uint32(sw.readyTimeout / time.Millisecond)})
+			readyErr = sw.waitReady(ctx, readier)
+		}
+	}
+	if startup.end() {
+		// The error, if any, is the result of the cancellation.
+		return
+	}
+	if err != nil {
+		elog.Error(1, fmt.Sprintf("When scheduling the service '%s': %s", sw.serviceName, err))
 		errno = 1
 		return
 	}
-	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
+	if sw.exitWhenScheduleReturns {
+		elog.Info(1, fmt.Sprintf("The service '%s' completed its work in Schedule", sw.serviceName))
+		return
+	}
+	if readyErr != nil {
+		elog.Error(1, fmt.Sprintf("When waiting for the service '%s' to become ready: %s", sw.serviceName, readyErr))
+		errno = 1
+		return
+	}
+	status.report(svc.Status{State: svc.Running, Accepts: cmdsAccepted})
+	if sw.livenessPath != "" {
+		if err := sw.startLivenessFile(ctx, wg, status); err != nil {
+			elog.Error(1, fmt.Sprintf("When starting the service '%s': %s", sw.serviceName, err))
+			errno = 1
+			return
+		}
+	}
+	logEvent(elog, Event{
+		Type:     windows.EVENTLOG_INFORMATION_TYPE,
+		Category: EventCategoryLifecycle,
+		ID:       1,
+		Message:  fmt.Sprintf("The service '%s' is %s", sw.serviceName, StateString(svc.Running)),
+	})
+	var draining atomic.Bool
 loop:
 	for {
 		select {
 		case <-ctx.Done():
 			elog.Info(1, "The wrapped service cancelled the execution")
-			wg.Wait()
+			stop.shutdown()
+			stop.join()
 			errno = 0
+			if exitErrorer, ok := sw.service.(ExitErrorer); ok {
+				if err := exitErrorer.ExitError(); err != nil {
+					ssec, errno = exitCode(err)
+					sw.setFailedFatally()
+					logEvent(elog, Event{
+						Type:     windows.EVENTLOG_ERROR_TYPE,
+						Category: EventCategoryLifecycle,
+						ID:       1,
+						Message:  fmt.Sprintf("The service '%s' cancelled itself due to a fatal error: %s", sw.serviceName, err),
+						Data:     exitCodeData(errno),
+					})
+				}
+			}
+			break loop
+		case <-lifecycle.failed:
+			ssec, errno = exitCode(lifecycle.err)
+			sw.setFailedFatally()
+			logEvent(elog, Event{
+				Type:     windows.EVENTLOG_ERROR_TYPE,
+				Category: EventCategoryLifecycle,
+				ID:       1,
+				Message:  fmt.Sprintf("The service '%s' failed: %s", sw.serviceName, lifecycle.err),
+				Data:     exitCodeData(errno),
+			})
 			break loop
 		case c := <-r:
+			if sw.interceptor != nil && sw.interceptor(c) {
+				continue
+			}
 			switch c.Cmd {
 			case svc.Interrogate:
-				changes <- c.CurrentStatus
-				// Testing deadlock from https://code.google.com/p/winsvc/issues/detail?id=4
-				time.Sleep(100 * time.Millisecond)
-				changes <- c.CurrentStatus
-			case svc.Stop, svc.Shutdown:
+				status.report(c.CurrentStatus)
+				if sw.interrogateDelay > 0 {
+					// Testing deadlock from https://code.google.com/p/winsvc/issues/detail?id=4
+					time.Sleep(sw.interrogateDelay)
+					status.report(c.CurrentStatus)
+				}
+			case svc.Stop, svc.Shutdown, svc.PreShutdown:
 				// golang.org/x/sys/windows/svc.TestExample is verifying this output.
 				testOutput := strings.Join(args, "-")
 				testOutput += fmt.Sprintf("-%d", c.Context)
 				elog.Info(1, testOutput)
-				cancel()
-				wg.Wait()
+				status.report(svc.Status{State: svc.StopPending})
 				break loop
+			case ControlSetLogLevel:
+				sw.setLogLevel()
+				status.report(c.CurrentStatus)
+			case svc.Pause, svc.Continue:
+				sw.pauseOrContinue(c, status, cmdsAccepted)
+			case svc.PowerEvent:
+				if c.EventType == pbtAPMPowerStatusChange && sw.mustStopForPower() {
+					elog.Info(1, fmt.Sprintf("The service '%s' only runs on AC power and is stopping", sw.serviceName))
+					status.report(svc.Status{State: svc.StopPending})
+					break loop
+				}
+				status.report(c.CurrentStatus)
+			case ControlDrain:
+				sw.drain(ctx, wg, status, &draining)
+				status.report(c.CurrentStatus)
 			default:
-				elog.Error(1, fmt.Sprintf("unexpected control request #%d", c))
+				elog.Warning(EventIDUnexpectedControl, fmt.Sprintf("unexpected control request #%d (event type %d)", c.Cmd, c.EventType))
+				status.report(c.CurrentStatus)
 			}
 		}
 	}
-	changes <- svc.Status{State: svc.StopPending}
 	return
 }
 
+// AcceptedCommands returns the controls the running service advertises to
+// the SCM, derived from the enabled features. The custom controls, such as
+// ControlSetLogLevel and ControlDrain, need no acceptance bit.
+func (sw *ServiceWrapper) AcceptedCommands() svc.Accepted {
+	accepted := svc.AcceptStop | svc.AcceptShutdown
+	if sw.preshutdownTimeout > 0 {
+		accepted |= svc.AcceptPreShutdown
+	}
+	if sw.powerPolicy != PowerPolicyAny {
+		accepted |= svc.AcceptPowerEvent
+	}
+	if _, ok := sw.service.(Pauser); ok {
+		accepted |= svc.AcceptPauseAndContinue
+	}
+	return accepted
+}
+
+// pauseOrContinue passes a pause or continue control to the Pauser of the
+// service.
+func (sw *ServiceWrapper) pauseOrContinue(c svc.ChangeRequest, status *statusReporter, accepted svc.Accepted) {
+	pauser, ok := sw.service.(Pauser)
+	if !ok {
+		elog.Warning(EventIDUnexpectedControl, fmt.Sprintf("unexpected control request #%d (event type %d)", c.Cmd, c.EventType))
+		status.report(c.CurrentStatus)
+		return
+	}
+	call, pending, done := pauser.Pause, svc.PausePending, svc.Paused
+	if c.Cmd == svc.Continue {
+		call, pending, done = pauser.Continue, svc.ContinuePending, svc.Running
+	}
+	status.report(svc.Status{State: pending, Accepts: accepted})
+	if err := call(); err != nil {
+		elog.Error(1, fmt.Sprintf("When changing the service '%s' to %s: %s", sw.serviceName, StateString(done), err))
+		status.report(c.CurrentStatus)
+		return
+	}
+	status.report(svc.Status{State: done, Accepts: accepted})
+}
+
+func (sw *ServiceWrapper) setLogLevel() {
+	setter, ok := sw.service.(LogLevelSetter)
+	if !ok {
+		elog.Warning(1, fmt.Sprintf("The service '%s' does not support changing the log level", sw.serviceName))
+		return
+	}
+	level, err := sw.readLogLevel()
+	if err != nil {
+		elog.Error(1, fmt.Sprintf("When reading the log level of the service '%s': %s", sw.serviceName, err))
+		return
+	}
+	if err := setter.SetLevel(level); err != nil {
+		elog.Error(1, fmt.Sprintf("When setting the log level of the service '%s' to %s: %s", sw.serviceName, level, err))
+		return
+	}
+	elog.Info(1, fmt.Sprintf("The log level of the service '%s' is now %s", sw.serviceName, level))
+}
+
+// startArgs strips the service name from the arguments passed to Execute,
+// substituting the command line arguments of a debug run, and the stored
+// StartArgs when the SCM passed none or only the restart attempt of
+// WithRestartOnFatal.
+func (sw *ServiceWrapper) startArgs(args []string) []string {
+	if sw.debugArgs != nil {
+		return sw.debugArgs
+	}
+	args = sw.stripRestartAttempt(args)
+	if len(args) > 1 {
+		return args[1:]
+	}
+	if sw.installStartArgs != nil {
+		return sw.installStartArgs
+	}
+	stored, err := sw.StartArgs()
+	if err != nil {
+		elog.Warning(1, fmt.Sprintf("When reading the start arguments of the service '%s': %s", sw.serviceName, err))
+	}
+	return stored
+}
+
+func (sw *ServiceWrapper) setRunContext(ctx context.Context, status *statusReporter) {
+	sw.runMu.Lock()
+	sw.runCtx = ctx
+	sw.runStatus = status
+	sw.runMu.Unlock()
+}
+
+// Context returns the context of the active run, for code that was not
+// handed the context passed to Schedule. It is only valid while Execute
+// runs and returns ErrNotRunning otherwise.
+func (sw *ServiceWrapper) Context() (context.Context, error) {
+	sw.runMu.Lock()
+	defer sw.runMu.Unlock()
+	if sw.runCtx == nil {
+		return nil, ErrNotRunning
+	}
+	return sw.runCtx, nil
+}
+
+func (sw *ServiceWrapper) setRunMode(mode RunMode) {
+	sw.runMu.Lock()
+	sw.runMode = mode
+	sw.runFatal = false
+	sw.runRestartAttempt = 0
+	sw.runMu.Unlock()
+}
+
+// setFailedFatally records that the run ended because of a fatal error of
+// the service, for WithRestartOnFatal.
+func (sw *ServiceWrapper) setFailedFatally() {
+	sw.runMu.Lock()
+	sw.runFatal = true
+	sw.runMu.Unlock()
+}
+
+func (sw *ServiceWrapper) failedFatally() bool {
+	sw.runMu.Lock()
+	defer sw.runMu.Unlock()
+	return sw.runFatal
+}
+
+// ReportStatus sends status to the SCM during a run, through the same
+// serialized writer as the wrapper, e.g. from a ChangeRequestInterceptor
+// answering a control itself. It returns ErrNotRunning outside a run and
+// once the final status has been sent.
+func (sw *ServiceWrapper) ReportStatus(status svc.Status) error {
+	sw.runMu.Lock()
+	reporter := sw.runStatus
+	sw.runMu.Unlock()
+	if reporter == nil || !reporter.report(status) {
+		return ErrNotRunning
+	}
+	return nil
+}
+
+// CurrentAccepted returns the controls the service currently advertises to
+// the SCM. Unlike AcceptedCommands it reflects the runtime status rather
+// than the config: while Schedule runs it is only AcceptStop and
+// AcceptShutdown, so that a slow start can be stopped, and it is zero once
+// the service starts stopping and outside a run.
+func (sw *ServiceWrapper) CurrentAccepted() svc.Accepted {
+	sw.runMu.Lock()
+	status := sw.runStatus
+	sw.runMu.Unlock()
+	if status == nil {
+		return 0
+	}
+	return status.status().Accepts
+}
+
+// LastRunMode returns the mode of the current or latest run,
+// e.g. for tests asserting which path ManageService took.
+func (sw *ServiceWrapper) LastRunMode() RunMode {
+	sw.runMu.Lock()
+	defer sw.runMu.Unlock()
+	return sw.runMode
+}
+
+// addCloser registers a resource to be released by Close. The returned
+// function releases it early; either way it is released only once.
+func (sw *ServiceWrapper) addCloser(close func() error) func() error {
+	var once sync.Once
+	var err error
+	closeOnce := func() error {
+		once.Do(func() { err = close() })
+		return err
+	}
+	sw.closeMu.Lock()
+	sw.closers = append(sw.closers, closeOnce)
+	sw.closeMu.Unlock()
+	return closeOnce
+}
+
+// Close releases the resources owned by the wrapper, such as an event log
+// left open by RunService. It is meant to be deferred by callers after
+// creating the wrapper, is idempotent and safe to call when nothing was
+// allocated:
+//
+//	sw, err := svchelper.GetServiceWrapper(...)
+//	if err != nil { ... }
+//	defer sw.Close()
+//	err = sw.ManageService()
+func (sw *ServiceWrapper) Close() error {
+	sw.closeMu.Lock()
+	closers := sw.closers
+	sw.closers = nil
+	sw.closeMu.Unlock()
+	var errs []error
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err := closers[i](); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (sw *ServiceWrapper) waitReady(ctx context.Context, readier Readier) error {
+	timer := time.NewTimer(sw.readyTimeout)
+	defer timer.Stop()
+	select {
+	case <-readier.Ready():
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("service cancelled before becoming ready")
+	case <-timer.C:
+		return fmt.Errorf("service not ready within %s", sw.readyTimeout)
+	}
+}
+
+// runService runs the service for RunService; tests replace it.
+var runService = (*ServiceWrapper).runService
+
 func (sw *ServiceWrapper) RunService(isDebug bool) error {
+	if !sw.running.CompareAndSwap(false, true) {
+		return fmt.Errorf("%s is already being run by this wrapper: %w", sw.serviceName, ErrAlreadyRunning)
+	}
+	err := runService(sw, isDebug)
+	sw.running.Store(false)
+	if err != nil || !sw.restartOnFatal || !sw.failedFatally() {
+		return err
+	}
+	return sw.restart(isDebug)
+}
+
+func (sw *ServiceWrapper) runService(isDebug bool) error {
+	mode := RunModeService
+	if isDebug {
+		mode = RunModeDebug
+	}
+	sw.setRunMode(mode)
+	if sw.instanceMutex != "" {
+		h, err := acquireInstanceMutex(sw.instanceMutex)
+		if err != nil {
+			return err
+		}
+		releaseMutex := sw.addCloser(func() error {
+			return windows.CloseHandle(h)
+		})
+		defer releaseMutex()
+	}
 	var err error
 	if isDebug {
 		elog = debug.New(sw.serviceName)
 	} else {
-		elog, err = eventlog.Open(sw.serviceName)
+		elog, err = sw.openEventLog()
 		if err != nil {
 			return fmt.Errorf("when opening the eventlog: %w", err)
 		}
 	}
-	defer elog.Close()
+	if sw.etwProvider != nil {
+		if log, err := openETWLog(*sw.etwProvider, elog); err != nil {
+			elog.Warning(1, fmt.Sprintf("When registering the ETW provider of the service '%s': %s", sw.serviceName, err))
+		} else {
+			elog = log
+		}
+	}
+	log := elog
+	closeLog := sw.addCloser(func() error {
+		sw.closeEventLog(log)
+		return nil
+	})
+	defer closeLog()
 
 	elog.Info(1, fmt.Sprintf("starting %s service", sw.serviceName))
+	if sw.verifyBinary {
+		if matches, err := sw.VerifyBinaryMatches(); err != nil {
+			elog.Warning(1, fmt.Sprintf("When verifying the binary of the service '%s': %s", sw.serviceName, err))
+		} else if !matches {
+			elog.Warning(1, fmt.Sprintf("The service '%s' is installed with another binary than the running one", sw.serviceName))
+		}
+	}
 	run := svc.Run
 	if isDebug {
 		run = debug.Run
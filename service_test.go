@@ -0,0 +1,985 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+)
+
+// scheduleFunc is a Service running a function as its Schedule.
+type scheduleFunc func(ctx context.Context, wg *sync.WaitGroup, cancel context.CancelFunc) error
+
+func (f scheduleFunc) Schedule(ctx context.Context, wg *sync.WaitGroup, cancel context.CancelFunc) error {
+	return f(ctx, wg, cancel)
+}
+
+// idle is a Service that starts nothing.
+var idle = scheduleFunc(func(context.Context, *sync.WaitGroup, context.CancelFunc) error { return nil })
+
+func newTestWrapper(t *testing.T, service Service, opts ...Option) *ServiceWrapper {
+	t.Helper()
+	sw, err := GetServiceWrapper(service, "svchelper-test", "svchelper test", "", false, opts...)
+	if err != nil {
+		t.Fatalf("GetServiceWrapper failed: %v", err)
+	}
+	return sw
+}
+
+// pausable adds no-op pause and continue support to a Service.
+type pausable struct{ Service }
+
+func (pausable) Pause() error    { return nil }
+func (pausable) Continue() error { return nil }
+
+func TestAcceptedCommands(t *testing.T) {
+	const base = svc.AcceptStop | svc.AcceptShutdown
+	driver := []Option{WithServiceType(windows.SERVICE_KERNEL_DRIVER), WithDriverPath(`C:\drivers\test.sys`), WithStartType(windows.SERVICE_DEMAND_START)}
+	tests := []struct {
+		desc    string
+		service Service
+		opts    []Option
+		want    svc.Accepted
+	}{
+		{desc: "default", service: idle, want: base},
+		{desc: "preshutdown", service: idle, opts: []Option{WithPreshutdownTimeout(time.Minute)}, want: base | svc.AcceptPreShutdown},
+		{desc: "power policy", service: idle, opts: []Option{WithPowerPolicy(PowerPolicyACOnly)}, want: base | svc.AcceptPowerEvent},
+		{desc: "power policy any", service: idle, opts: []Option{WithPowerPolicy(PowerPolicyAny)}, want: base},
+		{desc: "pauser", service: pausable{idle}, want: base | svc.AcceptPauseAndContinue},
+		{desc: "everything", service: pausable{idle}, opts: []Option{WithPreshutdownTimeout(time.Minute), WithPowerPolicy(PowerPolicyACOnly)},
+			want: base | svc.AcceptPreShutdown | svc.AcceptPowerEvent | svc.AcceptPauseAndContinue},
+		{desc: "driver", service: idle, opts: driver, want: base},
+	}
+	for _, tt := range tests {
+		sw := newTestWrapper(t, tt.service, tt.opts...)
+		if got := sw.AcceptedCommands(); got != tt.want {
+			t.Errorf("%s: AcceptedCommands() = %#x, want %#x", tt.desc, got, tt.want)
+		}
+	}
+}
+
+// execution drives Execute the way svc.Run does, recording every status
+// Execute reports.
+type execution struct {
+	requests chan svc.ChangeRequest
+	done     chan struct{}
+	ssec     bool
+	errno    uint32
+
+	mu       sync.Mutex
+	statuses []svc.Status
+}
+
+func newExecution() *execution {
+	return &execution{requests: make(chan svc.ChangeRequest, 1), done: make(chan struct{})}
+}
+
+func (e *execution) observe(s svc.Status) {
+	e.mu.Lock()
+	e.statuses = append(e.statuses, s)
+	e.mu.Unlock()
+}
+
+// start runs Execute on a wrapper created with WithStatusObserver(e.observe).
+func (e *execution) start(sw *ServiceWrapper) {
+	e.startWithArgs(sw, []string{sw.serviceName})
+}
+
+// startWithArgs is start passing the SCM arguments args to Execute.
+func (e *execution) startWithArgs(sw *ServiceWrapper, args []string) {
+	changes := make(chan svc.Status)
+	go func() {
+		for {
+			select {
+			case <-changes:
+			case <-e.done:
+				return
+			}
+		}
+	}()
+	go func() {
+		defer close(e.done)
+		e.ssec, e.errno = sw.Execute(args, e.requests, changes)
+	}()
+}
+
+func (e *execution) history() []svc.Status {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]svc.Status(nil), e.statuses...)
+}
+
+// waitFor waits until Execute has reported state.
+func (e *execution) waitFor(t *testing.T, state svc.State) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, s := range e.history() {
+			if s.State == state {
+				return
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("the service never reported %s, got %v", StateString(state), e.history())
+}
+
+func (e *execution) send(cmd svc.Cmd) {
+	e.requests <- svc.ChangeRequest{Cmd: cmd}
+}
+
+// wait waits for Execute to return and returns its result.
+func (e *execution) wait(t *testing.T) (bool, uint32) {
+	t.Helper()
+	select {
+	case <-e.done:
+		return e.ssec, e.errno
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Execute did not return, statuses %v", e.history())
+		return false, 0
+	}
+}
+
+func (e *execution) reported(state svc.State) bool {
+	for _, s := range e.history() {
+		if s.State == state {
+			return true
+		}
+	}
+	return false
+}
+
+// readier is a Service that becomes ready when ready is closed.
+type readier struct {
+	Service
+	ready chan struct{}
+}
+
+func (r readier) Ready() <-chan struct{} { return r.ready }
+
+func TestExecuteWaitsForReadiness(t *testing.T) {
+	e := newExecution()
+	service := readier{Service: idle, ready: make(chan struct{})}
+	sw := newTestWrapper(t, service, WithStatusObserver(e.observe), WithReadyTimeout(5*time.Second))
+	e.start(sw)
+	time.Sleep(50 * time.Millisecond)
+	if e.reported(svc.Running) {
+		t.Fatal("the service was reported Running before it was ready")
+	}
+	close(service.ready)
+	e.waitFor(t, svc.Running)
+	e.send(svc.Stop)
+	if _, errno := e.wait(t); errno != 0 {
+		t.Errorf("Execute returned errno %d, want 0", errno)
+	}
+}
+
+func TestExecuteReadinessTimeout(t *testing.T) {
+	e := newExecution()
+	service := readier{Service: idle, ready: make(chan struct{})}
+	sw := newTestWrapper(t, service, WithStatusObserver(e.observe), WithReadyTimeout(50*time.Millisecond))
+	e.start(sw)
+	if _, errno := e.wait(t); errno == 0 {
+		t.Error("Execute returned errno 0 for a service that never became ready")
+	}
+	if e.reported(svc.Running) {
+		t.Error("a service that never became ready was reported Running")
+	}
+}
+
+// selfCancelling is a Service cancelling itself once running, with exitErr
+// as its ExitError.
+type selfCancelling struct {
+	exitErr error
+}
+
+func (s *selfCancelling) Schedule(ctx context.Context, wg *sync.WaitGroup, cancel context.CancelFunc) error {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	return nil
+}
+
+func (s *selfCancelling) ExitError() error { return s.exitErr }
+
+func TestExecuteSelfCancel(t *testing.T) {
+	tests := []struct {
+		desc      string
+		exitErr   error
+		wantErrno uint32
+	}{
+		{desc: "clean", exitErr: nil, wantErrno: 0},
+		{desc: "fatal", exitErr: errors.New("disk gone"), wantErrno: 1},
+	}
+	for _, tt := range tests {
+		e := newExecution()
+		sw := newTestWrapper(t, &selfCancelling{exitErr: tt.exitErr}, WithStatusObserver(e.observe))
+		e.start(sw)
+		ssec, errno := e.wait(t)
+		if ssec || errno != tt.wantErrno {
+			t.Errorf("%s: Execute returned (%t, %d), want (false, %d)", tt.desc, ssec, errno, tt.wantErrno)
+		}
+		if got := sw.failedFatally(); got != (tt.exitErr != nil) {
+			t.Errorf("%s: failedFatally() = %t", tt.desc, got)
+		}
+	}
+}
+
+// exitCodeError is an error carrying a service-specific exit code.
+type exitCodeError struct{ code uint32 }
+
+func (e exitCodeError) Error() string    { return "failed" }
+func (e exitCodeError) ExitCode() uint32 { return e.code }
+
+// failing is a Service failing through its Lifecycle once running.
+type failing struct {
+	err       error
+	lifecycle *Lifecycle
+}
+
+func (f *failing) SetLifecycle(lifecycle *Lifecycle) { f.lifecycle = lifecycle }
+
+func (f *failing) Schedule(ctx context.Context, wg *sync.WaitGroup, cancel context.CancelFunc) error {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(20 * time.Millisecond)
+		f.lifecycle.Fail(f.err)
+	}()
+	return nil
+}
+
+func TestExecuteLifecycleFail(t *testing.T) {
+	tests := []struct {
+		desc      string
+		err       error
+		wantSsec  bool
+		wantErrno uint32
+	}{
+		{desc: "plain error", err: errors.New("broken"), wantErrno: 1},
+		{desc: "nil error", err: nil, wantErrno: 1},
+		{desc: "exit code", err: exitCodeError{code: 42}, wantSsec: true, wantErrno: 42},
+		{desc: "wrapped exit code", err: fmt.Errorf("when syncing: %w", exitCodeError{code: 7}), wantSsec: true, wantErrno: 7},
+	}
+	for _, tt := range tests {
+		e := newExecution()
+		sw := newTestWrapper(t, &failing{err: tt.err}, WithStatusObserver(e.observe))
+		e.start(sw)
+		e.waitFor(t, svc.Running)
+		ssec, errno := e.wait(t)
+		if ssec != tt.wantSsec || errno != tt.wantErrno {
+			t.Errorf("%s: Execute returned (%t, %d), want (%t, %d)", tt.desc, ssec, errno, tt.wantSsec, tt.wantErrno)
+		}
+	}
+}
+
+// stopFailing is a Service whose shutdown path fails with err.
+type stopFailing struct {
+	Service
+	err error
+}
+
+func (s stopFailing) StopError() error { return s.err }
+
+func TestExecuteStopError(t *testing.T) {
+	tests := []struct {
+		desc      string
+		err       error
+		wantSsec  bool
+		wantErrno uint32
+	}{
+		{desc: "clean stop", err: nil, wantErrno: 0},
+		{desc: "flush failed", err: errors.New("flush failed"), wantErrno: 1},
+		{desc: "exit code", err: exitCodeError{code: 3}, wantSsec: true, wantErrno: 3},
+	}
+	for _, tt := range tests {
+		e := newExecution()
+		sw := newTestWrapper(t, stopFailing{Service: idle, err: tt.err}, WithStatusObserver(e.observe))
+		e.start(sw)
+		e.waitFor(t, svc.Running)
+		e.send(svc.Stop)
+		ssec, errno := e.wait(t)
+		if ssec != tt.wantSsec || errno != tt.wantErrno {
+			t.Errorf("%s: Execute returned (%t, %d), want (%t, %d)", tt.desc, ssec, errno, tt.wantSsec, tt.wantErrno)
+		}
+	}
+}
+
+func TestExecuteExitWhenScheduleReturns(t *testing.T) {
+	e := newExecution()
+	sw := newTestWrapper(t, idle, WithStatusObserver(e.observe), WithExitWhenScheduleReturns())
+	e.start(sw)
+	if ssec, errno := e.wait(t); ssec || errno != 0 {
+		t.Errorf("Execute returned (%t, %d), want a clean stop", ssec, errno)
+	}
+	if e.reported(svc.Running) {
+		t.Error("a service done in Schedule was reported Running")
+	}
+}
+
+func TestExecuteKeepsRunningAfterSchedule(t *testing.T) {
+	e := newExecution()
+	sw := newTestWrapper(t, idle, WithStatusObserver(e.observe))
+	e.start(sw)
+	e.waitFor(t, svc.Running)
+	select {
+	case <-e.done:
+		t.Fatal("Execute returned without being stopped")
+	case <-time.After(100 * time.Millisecond):
+	}
+	e.send(svc.Stop)
+	if _, errno := e.wait(t); errno != 0 {
+		t.Errorf("Execute returned errno %d, want 0", errno)
+	}
+}
+
+// worker is a Service with one goroutine that returns a little after the
+// context is cancelled, leaving the run through the given route.
+type worker struct {
+	route       string
+	lifecycle   *Lifecycle
+	returned    atomic.Bool
+	shutdownRan atomic.Bool
+}
+
+func (w *worker) SetLifecycle(lifecycle *Lifecycle) { w.lifecycle = lifecycle }
+
+func (w *worker) Shutdown(ctx context.Context) error {
+	w.shutdownRan.Store(true)
+	return nil
+}
+
+func (w *worker) Schedule(ctx context.Context, wg *sync.WaitGroup, cancel context.CancelFunc) error {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		time.Sleep(20 * time.Millisecond)
+		w.returned.Store(true)
+	}()
+	switch w.route {
+	case "schedule error":
+		return errors.New("half started")
+	case "self-cancel":
+		go cancel()
+	case "fail":
+		go w.lifecycle.Fail(errors.New("broken"))
+	}
+	return nil
+}
+
+func TestExecuteJoinsGoroutines(t *testing.T) {
+	for _, route := range []string{"schedule error", "stop", "self-cancel", "fail"} {
+		e := newExecution()
+		w := &worker{route: route}
+		sw := newTestWrapper(t, w, WithStatusObserver(e.observe))
+		e.start(sw)
+		if route == "stop" {
+			e.waitFor(t, svc.Running)
+			e.send(svc.Stop)
+		}
+		e.wait(t)
+		if !w.returned.Load() {
+			t.Errorf("%s: Execute returned before the goroutine of the service", route)
+		}
+		if !w.shutdownRan.Load() {
+			t.Errorf("%s: the Shutdowner was not called", route)
+		}
+	}
+}
+
+func TestExecuteNoShutdownBeforeSchedule(t *testing.T) {
+	e := newExecution()
+	w := &worker{}
+	// The health endpoint cannot bind, so the run ends before Schedule.
+	sw := newTestWrapper(t, w, WithStatusObserver(e.observe), WithHealthEndpoint("256.0.0.1:0"))
+	e.start(sw)
+	if _, errno := e.wait(t); errno == 0 {
+		t.Error("Execute returned errno 0 although the health endpoint failed")
+	}
+	if w.shutdownRan.Load() {
+		t.Error("the Shutdowner was called although Schedule never ran")
+	}
+}
+
+// stuck is a Service whose Shutdown and goroutine both outlive the stop
+// deadline; the goroutine returns when release is closed.
+type stuck struct{ release chan struct{} }
+
+func (s stuck) Shutdown(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (s stuck) Schedule(ctx context.Context, wg *sync.WaitGroup, cancel context.CancelFunc) error {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-s.release
+	}()
+	return nil
+}
+
+func TestExecuteSharedStopDeadline(t *testing.T) {
+	const timeout = 300 * time.Millisecond
+	s := stuck{release: make(chan struct{})}
+	defer close(s.release)
+	e := newExecution()
+	sw := newTestWrapper(t, s, WithStatusObserver(e.observe), WithStopTimeout(timeout))
+	e.start(sw)
+	e.waitFor(t, svc.Running)
+	begin := time.Now()
+	e.send(svc.Stop)
+	e.wait(t)
+	// Shutdown uses up the whole deadline, so joining must not wait again.
+	if took := time.Since(begin); took < timeout || took > timeout*3/2 {
+		t.Errorf("stopping took %s, want about the stop timeout of %s", took, timeout)
+	}
+}
+
+// graceful is a GracefulStopper recording whether BeginShutdown came before
+// the context was cancelled.
+type graceful struct {
+	began         atomic.Bool
+	beganAtCancel atomic.Bool
+}
+
+func (g *graceful) BeginShutdown() { g.began.Store(true) }
+
+func (g *graceful) Schedule(ctx context.Context, wg *sync.WaitGroup, cancel context.CancelFunc) error {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		g.beganAtCancel.Store(g.began.Load())
+	}()
+	return nil
+}
+
+func TestExecuteGracefulStop(t *testing.T) {
+	const delay = 1500 * time.Millisecond
+	g := &graceful{}
+	e := newExecution()
+	sw := newTestWrapper(t, g, WithStatusObserver(e.observe), WithGracefulStopDelay(delay))
+	e.start(sw)
+	e.waitFor(t, svc.Running)
+	begin := time.Now()
+	e.send(svc.Stop)
+	e.wait(t)
+	if !g.beganAtCancel.Load() {
+		t.Error("the context was cancelled before BeginShutdown was called")
+	}
+	if took := time.Since(begin); took < delay {
+		t.Errorf("stopping took %s, want at least the graceful stop delay of %s", took, delay)
+	}
+	var checkpoints []uint32
+	for _, s := range e.history() {
+		if s.State == svc.StopPending && s.WaitHint == uint32(delay/time.Millisecond) {
+			checkpoints = append(checkpoints, s.CheckPoint)
+		}
+	}
+	if len(checkpoints) < 2 || checkpoints[len(checkpoints)-1] == 0 {
+		t.Errorf("StopPending checkpoints during the delay = %v, want an advancing checkpoint", checkpoints)
+	}
+}
+
+// states returns the states of statuses with repeats collapsed.
+func states(statuses []svc.Status) []svc.State {
+	var seq []svc.State
+	for _, s := range statuses {
+		if len(seq) == 0 || seq[len(seq)-1] != s.State {
+			seq = append(seq, s.State)
+		}
+	}
+	return seq
+}
+
+func TestStatusObserverSequence(t *testing.T) {
+	e := newExecution()
+	sw := newTestWrapper(t, idle, WithStatusObserver(e.observe))
+	e.start(sw)
+	e.waitFor(t, svc.Running)
+	e.send(svc.Stop)
+	e.wait(t)
+	got := states(e.history())
+	want := []svc.State{svc.StartPending, svc.Running, svc.StopPending}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("observed states %v, want %v", got, want)
+	}
+}
+
+func TestExecuteFinalStatus(t *testing.T) {
+	e := newExecution()
+	// The graceful stop delay reports a StopPending with a WaitHint first.
+	sw := newTestWrapper(t, idle, WithStatusObserver(e.observe), WithGracefulStopDelay(time.Second))
+	e.start(sw)
+	e.waitFor(t, svc.Running)
+	e.send(svc.Stop)
+	e.wait(t)
+	history := e.history()
+	final := history[len(history)-1]
+	if final.State != svc.StopPending || final.CheckPoint != 0 || final.WaitHint != 0 || final.Accepts != 0 {
+		t.Errorf("final status %+v, want a bare StopPending", final)
+	}
+}
+
+// drainer is a Drainer whose Drain returns when inFlight is closed.
+type drainer struct {
+	Service
+	started  chan struct{}
+	inFlight chan struct{}
+	drained  atomic.Bool
+}
+
+func (d *drainer) Drain(ctx context.Context) error {
+	close(d.started)
+	select {
+	case <-d.inFlight:
+		d.drained.Store(true)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestExecuteDrainThenStop(t *testing.T) {
+	d := &drainer{Service: idle, started: make(chan struct{}), inFlight: make(chan struct{})}
+	e := newExecution()
+	sw := newTestWrapper(t, d, WithStatusObserver(e.observe))
+	e.start(sw)
+	e.waitFor(t, svc.Running)
+	e.send(ControlDrain)
+	select {
+	case <-d.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Drain was never called")
+	}
+	// Draining reports progress while the service keeps running.
+	time.Sleep(drainProgressInterval + 200*time.Millisecond)
+	var advanced bool
+	for _, s := range e.history() {
+		if s.State == svc.Running && s.CheckPoint > 0 {
+			advanced = true
+		}
+		if s.State == svc.StopPending {
+			t.Fatal("the service stopped while draining")
+		}
+	}
+	if !advanced {
+		t.Error("the checkpoint did not advance while draining")
+	}
+	close(d.inFlight)
+	for deadline := time.Now().Add(5 * time.Second); !d.drained.Load(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the drain did not complete")
+		}
+	}
+	e.send(svc.Stop)
+	if _, errno := e.wait(t); errno != 0 {
+		t.Errorf("Execute returned errno %d, want 0", errno)
+	}
+	if got := states(e.history()); got[len(got)-1] != svc.StopPending {
+		t.Errorf("observed states %v, want the drained service to stop", got)
+	}
+}
+
+func TestExecuteStopDuringSchedule(t *testing.T) {
+	entered := make(chan struct{})
+	slow := scheduleFunc(func(ctx context.Context, wg *sync.WaitGroup, cancel context.CancelFunc) error {
+		close(entered)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	e := newExecution()
+	sw := newTestWrapper(t, slow, WithStatusObserver(e.observe))
+	e.start(sw)
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Schedule was never called")
+	}
+	e.send(svc.Stop)
+	if _, errno := e.wait(t); errno != 0 {
+		t.Errorf("Execute returned errno %d for a stop during Schedule, want 0", errno)
+	}
+	if e.reported(svc.Running) {
+		t.Error("a service stopped during Schedule was reported Running")
+	}
+}
+
+// fakeRun makes RunService call run in place of the real run until the test
+// ends.
+func fakeRun(t *testing.T, run func(sw *ServiceWrapper, isDebug bool) error) {
+	previous := runService
+	runService = run
+	t.Cleanup(func() { runService = previous })
+}
+
+func TestRunServiceConcurrently(t *testing.T) {
+	sw := newTestWrapper(t, idle)
+	entered, release := make(chan struct{}), make(chan struct{})
+	var runs atomic.Int32
+	fakeRun(t, func(sw *ServiceWrapper, isDebug bool) error {
+		runs.Add(1)
+		close(entered)
+		<-release
+		return nil
+	})
+	first := make(chan error, 1)
+	go func() { first <- sw.RunService(true) }()
+	<-entered
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- sw.RunService(true)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if !errors.Is(err, ErrAlreadyRunning) {
+			t.Errorf("a concurrent RunService returned %v, want ErrAlreadyRunning", err)
+		}
+	}
+	close(release)
+	if err := <-first; err != nil {
+		t.Errorf("the first RunService returned %v", err)
+	}
+	if n := runs.Load(); n != 1 {
+		t.Errorf("the run function was entered %d times, want once", n)
+	}
+	// Once the run has ended, the wrapper can run again.
+	fakeRun(t, func(*ServiceWrapper, bool) error { return nil })
+	if err := sw.RunService(true); err != nil {
+		t.Errorf("RunService after the first run returned %v", err)
+	}
+}
+
+// levelRecorder is a LogLevelSetter passing on the levels it is set to.
+type levelRecorder struct {
+	Service
+	levels chan string
+}
+
+func (l levelRecorder) SetLevel(level string) error {
+	l.levels <- level
+	return nil
+}
+
+func TestExecuteSetLogLevel(t *testing.T) {
+	// The level is read from the Parameters key of the installed service.
+	installed := installTestService(t)
+	if err := installed.writeLogLevel("debug"); err != nil {
+		t.Fatalf("writeLogLevel failed: %v", err)
+	}
+	recorder := levelRecorder{Service: idle, levels: make(chan string, 1)}
+	e := newExecution()
+	sw := newInstallWrapper(t, recorder, WithStatusObserver(e.observe))
+	e.start(sw)
+	e.waitFor(t, svc.Running)
+	e.send(ControlSetLogLevel)
+	select {
+	case level := <-recorder.levels:
+		if level != "debug" {
+			t.Errorf("SetLevel(%q), want debug", level)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the control did not reach SetLevel")
+	}
+	e.send(svc.Stop)
+	if _, errno := e.wait(t); errno != 0 {
+		t.Errorf("Execute returned errno %d, want 0", errno)
+	}
+}
+
+// argsRecorder is an ArgsReceiver recording its start arguments.
+type argsRecorder struct {
+	Service
+	args []string
+}
+
+func (a *argsRecorder) SetArgs(args []string) { a.args = args }
+
+func TestDebugArgs(t *testing.T) {
+	recorder := &argsRecorder{Service: idle}
+	e := newExecution()
+	sw := newTestWrapper(t, recorder, WithStatusObserver(e.observe))
+	// Run Execute as debug.Run would, with the service name only.
+	fakeRun(t, func(sw *ServiceWrapper, isDebug bool) error {
+		if !isDebug {
+			t.Error("the debug command did not run the service in debug mode")
+		}
+		e.start(sw)
+		e.waitFor(t, svc.Running)
+		e.send(svc.Stop)
+		e.wait(t)
+		return nil
+	})
+	args := os.Args
+	defer func() { os.Args = args }()
+	os.Args = []string{args[0], "--service-name", "svchelper-debug", "debug", "-config", "dev.json", "debug"}
+	if err := sw.ManageService(); err != nil {
+		t.Fatalf("ManageService failed: %v", err)
+	}
+	want := []string{"-config", "dev.json", "debug"}
+	if fmt.Sprint(recorder.args) != fmt.Sprint(want) {
+		t.Errorf("the service received %q, want %q", recorder.args, want)
+	}
+}
+
+// fakeRestart makes a debug run restarting after a fatal error pass the
+// command starting the executable again to run until the test ends.
+func fakeRestart(t *testing.T, run func(cmd *exec.Cmd) error) {
+	previous := runRestarted
+	runRestarted = run
+	t.Cleanup(func() { runRestarted = previous })
+}
+
+func TestRestartOnFatalDebug(t *testing.T) {
+	// Run Execute as debug.Run would.
+	fakeRun(t, func(sw *ServiceWrapper, isDebug bool) error {
+		sw.setRunMode(RunModeDebug)
+		e := newExecution()
+		e.start(sw)
+		e.wait(t)
+		return nil
+	})
+	var restarts []*exec.Cmd
+	fakeRestart(t, func(cmd *exec.Cmd) error {
+		restarts = append(restarts, cmd)
+		return nil
+	})
+	const delay = 50 * time.Millisecond
+	sw := newTestWrapper(t, &failing{err: errors.New("broken")}, WithRestartOnFatal(true), WithRestartLimit(2, delay))
+
+	begin := time.Now()
+	if err := sw.RunService(true); err != nil {
+		t.Fatalf("RunService failed: %v", err)
+	}
+	if len(restarts) != 1 {
+		t.Fatalf("the executable was started again %d times, want once", len(restarts))
+	}
+	if took := time.Since(begin); took < delay {
+		t.Errorf("the executable was started again after %s, want a delay of %s", took, delay)
+	}
+	if got, want := fmt.Sprint(restarts[0].Args[1:]), fmt.Sprint(os.Args[1:]); got != want {
+		t.Errorf("the executable was started again with %s, want %s", got, want)
+	}
+	if !hasEnv(restarts[0].Env, restartAttemptEnv+"=1") {
+		t.Errorf("the first restart does not set %s=1", restartAttemptEnv)
+	}
+
+	// The executable started again counts on from its attempt, up to the
+	// limit.
+	restarts = nil
+	t.Setenv(restartAttemptEnv, "1")
+	if err := sw.RunService(true); err != nil {
+		t.Fatalf("RunService of the first restart failed: %v", err)
+	}
+	if len(restarts) != 1 || !hasEnv(restarts[0].Env, restartAttemptEnv+"=2") {
+		t.Errorf("the first restart did not start attempt 2")
+	}
+	restarts = nil
+	t.Setenv(restartAttemptEnv, "2")
+	if err := sw.RunService(true); err == nil {
+		t.Error("RunService past the restart limit succeeded")
+	}
+	if len(restarts) > 0 {
+		t.Error("the executable was started again past the restart limit")
+	}
+
+	// Runs ending cleanly or without WithRestartOnFatal are not restarted.
+	t.Setenv(restartAttemptEnv, "")
+	for _, sw := range []*ServiceWrapper{
+		newTestWrapper(t, &selfCancelling{}, WithRestartOnFatal(true)),
+		newTestWrapper(t, &failing{err: errors.New("broken")}),
+	} {
+		if err := sw.RunService(true); err != nil {
+			t.Errorf("RunService failed: %v", err)
+		}
+	}
+	if len(restarts) > 0 {
+		t.Errorf("the executable was started again %d times, want none", len(restarts))
+	}
+}
+
+func hasEnv(env []string, variable string) bool {
+	for _, v := range env {
+		if v == variable {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRestartAttemptArgs(t *testing.T) {
+	sw := newTestWrapper(t, idle, WithStartArgs("-config", "prod.json"))
+	sw.setRunMode(RunModeService)
+	if args := sw.startArgs([]string{sw.serviceName, restartAttemptArg, "2"}); fmt.Sprint(args) != "[-config prod.json]" {
+		t.Errorf("a restarted service gets the start arguments %q, want the stored ones", args)
+	}
+	if attempt := sw.restartAttempt(false); attempt != 2 {
+		t.Errorf("restartAttempt() = %d, want 2", attempt)
+	}
+	sw.setRunMode(RunModeService)
+	if args := sw.startArgs([]string{sw.serviceName, "-verbose"}); fmt.Sprint(args) != "[-verbose]" {
+		t.Errorf("a started service gets the start arguments %q, want [-verbose]", args)
+	}
+	if attempt := sw.restartAttempt(false); attempt != 0 {
+		t.Errorf("restartAttempt() = %d for a service that was not restarted, want 0", attempt)
+	}
+}
+
+func TestChangeRequestInterceptor(t *testing.T) {
+	// The interceptor takes the stop requests until intercept is cleared.
+	var intercept atomic.Bool
+	intercept.Store(true)
+	seen := make(chan svc.Cmd, 10)
+	interceptor := func(c svc.ChangeRequest) bool {
+		seen <- c.Cmd
+		return intercept.Load() && c.Cmd == svc.Stop
+	}
+	intercepted := func(want svc.Cmd) {
+		t.Helper()
+		select {
+		case cmd := <-seen:
+			if cmd != want {
+				t.Errorf("the interceptor saw control %d, want %d", cmd, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the interceptor never saw control %d", want)
+		}
+	}
+	e := newExecution()
+	service := readier{Service: idle, ready: make(chan struct{})}
+	sw := newTestWrapper(t, service, WithStatusObserver(e.observe), WithReadyTimeout(5*time.Second),
+		WithChangeRequestInterceptor(interceptor))
+	e.start(sw)
+	e.waitFor(t, svc.StartPending)
+
+	// A stop while starting goes to the interceptor before the startup
+	// watcher.
+	e.send(svc.Stop)
+	intercepted(svc.Stop)
+	close(service.ready)
+	e.waitFor(t, svc.Running)
+	if e.reported(svc.StopPending) {
+		t.Fatal("the intercepted stop while starting stopped the service")
+	}
+
+	// So does a stop while running, and requests the interceptor declines
+	// fall through to the default handling.
+	e.send(svc.Stop)
+	intercepted(svc.Stop)
+	e.send(svc.Interrogate)
+	intercepted(svc.Interrogate)
+	if e.reported(svc.StopPending) {
+		t.Fatal("the intercepted stop stopped the running service")
+	}
+	intercept.Store(false)
+	e.send(svc.Stop)
+	intercepted(svc.Stop)
+	if _, errno := e.wait(t); errno != 0 {
+		t.Errorf("Execute returned errno %d, want 0", errno)
+	}
+	if !e.reported(svc.StopPending) {
+		t.Error("the stop declined by the interceptor did not stop the service")
+	}
+}
+
+// slowStarter is a Shutdowner whose Schedule blocks until its context is
+// cancelled and then reports whether Shutdown ran first.
+type slowStarter struct {
+	entered       chan struct{}
+	shutdownRan   atomic.Bool
+	shutdownFirst chan bool
+}
+
+func (s *slowStarter) Shutdown(ctx context.Context) error {
+	s.shutdownRan.Store(true)
+	return nil
+}
+
+func (s *slowStarter) Schedule(ctx context.Context, wg *sync.WaitGroup, cancel context.CancelFunc) error {
+	close(s.entered)
+	<-ctx.Done()
+	s.shutdownFirst <- s.shutdownRan.Load()
+	return ctx.Err()
+}
+
+func TestExecuteStopDuringScheduleShutsDown(t *testing.T) {
+	s := &slowStarter{entered: make(chan struct{}), shutdownFirst: make(chan bool, 1)}
+	e := newExecution()
+	sw := newTestWrapper(t, s, WithStatusObserver(e.observe))
+	e.start(sw)
+	select {
+	case <-s.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Schedule was never called")
+	}
+	e.send(svc.Stop)
+	if _, errno := e.wait(t); errno != 0 {
+		t.Errorf("Execute returned errno %d for a stop during Schedule, want 0", errno)
+	}
+	if !<-s.shutdownFirst {
+		t.Error("the context was cancelled before Shutdown ran")
+	}
+}
+
+func TestArgsFromContext(t *testing.T) {
+	if args := ArgsFromContext(context.Background()); args != nil {
+		t.Errorf("ArgsFromContext of a context without a run = %q, want nil", args)
+	}
+	tests := []struct {
+		desc string
+		args []string
+		opts []Option
+		want []string
+	}{
+		{desc: "SCM arguments", args: []string{"svchelper-test", "-config", "prod.json"}, want: []string{"-config", "prod.json"}},
+		{desc: "stored arguments", args: []string{"svchelper-test"}, opts: []Option{WithStartArgs("-stored")}, want: []string{"-stored"}},
+	}
+	for _, tt := range tests {
+		got := make(chan []string, 2)
+		service := scheduleFunc(func(ctx context.Context, wg *sync.WaitGroup, cancel context.CancelFunc) error {
+			got <- ArgsFromContext(ctx)
+			// Contexts derived from the run context carry them too.
+			derived, stop := context.WithTimeout(ctx, time.Minute)
+			defer stop()
+			got <- ArgsFromContext(derived)
+			return nil
+		})
+		e := newExecution()
+		sw := newTestWrapper(t, service, append(tt.opts, WithStatusObserver(e.observe))...)
+		e.startWithArgs(sw, tt.args)
+		e.waitFor(t, svc.Running)
+		for _, from := range []string{"run", "derived"} {
+			if args := <-got; fmt.Sprint(args) != fmt.Sprint(tt.want) {
+				t.Errorf("%s: ArgsFromContext of the %s context = %q, want %q", tt.desc, from, args, tt.want)
+			}
+		}
+		e.send(svc.Stop)
+		e.wait(t)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// gracefulStopProgressInterval is how often the checkpoint is advanced
+// during the graceful stop delay.
+const gracefulStopProgressInterval = time.Second
+
+// Shutdowner can optionally be implemented by a Service needing an ordered
+// shutdown. Shutdown is called when the service is to stop, before its
+// context is cancelled; ctx expires at the stop deadline set by
+// WithStopTimeout. A stop sent while Schedule is still running calls
+// Shutdown, and BeginShutdown of a GracefulStopper, while Schedule runs.
+type Shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// GracefulStopper can optionally be implemented by a Service with workers
+// that should stop taking new work before the context is cancelled.
+// BeginShutdown is called first when the service is to stop; the context is
+// then cancelled once the goroutines of the service have returned or the
+// WithGracefulStopDelay delay has passed, whichever comes first.
+type GracefulStopper interface {
+	BeginShutdown()
+}
+
+// stopSequence runs the phases of stopping a service, GracefulStopper and
+// Shutdowner calls, the graceful stop delay and joining the service
+// goroutines, each at most once and all bounded by one deadline that starts
+// when the first phase does.
+type stopSequence struct {
+	sw           *ServiceWrapper
+	wg           *sync.WaitGroup
+	status       *statusReporter
+	waitOnce     sync.Once
+	waited       chan struct{}
+	deadlineOnce sync.Once
+	ctx          context.Context
+	release      context.CancelFunc
+	shutdownOnce sync.Once
+	joinOnce     sync.Once
+	armed        bool
+}
+
+func newStopSequence(sw *ServiceWrapper, wg *sync.WaitGroup, status *statusReporter) *stopSequence {
+	return &stopSequence{sw: sw, wg: wg, status: status}
+}
+
+// goroutinesDone returns a channel closed once wg is done.
+func (st *stopSequence) goroutinesDone() <-chan struct{} {
+	st.waitOnce.Do(func() {
+		st.waited = make(chan struct{})
+		go func() {
+			st.wg.Wait()
+			close(st.waited)
+		}()
+	})
+	return st.waited
+}
+
+func (st *stopSequence) deadline() context.Context {
+	st.deadlineOnce.Do(func() {
+		if st.sw.stopTimeout > 0 {
+			st.ctx, st.release = context.WithTimeout(context.Background(), st.sw.stopTimeout)
+		} else {
+			st.ctx, st.release = context.WithCancel(context.Background())
+		}
+	})
+	return st.ctx
+}
+
+// arm enables the shutdown phases. Execute calls it right before it starts
+// watching for a stop during Schedule, so a service that never got
+// scheduled is not asked to shut down.
+func (st *stopSequence) arm() {
+	st.armed = true
+}
+
+// shutdown calls the GracefulStopper and Shutdowner of the service, if any,
+// and waits for the graceful stop delay. It does nothing before arm.
+func (st *stopSequence) shutdown() {
+	if !st.armed {
+		return
+	}
+	st.shutdownOnce.Do(func() {
+		if stopper, ok := st.sw.service.(GracefulStopper); ok {
+			stopper.BeginShutdown()
+		}
+		if shutdowner, ok := st.sw.service.(Shutdowner); ok {
+			if err := shutdowner.Shutdown(st.deadline()); err != nil {
+				elog.Error(1, fmt.Sprintf("When shutting down the service '%s': %s", st.sw.serviceName, err))
+			}
+		}
+		st.grace()
+	})
+}
+
+// grace gives the goroutines of the service the graceful stop delay to
+// return before the context is cancelled, advancing the StopPending
+// checkpoint meanwhile.
+func (st *stopSequence) grace() {
+	delay := st.sw.gracefulStopDelay
+	if delay <= 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	ticker := time.NewTicker(gracefulStopProgressInterval)
+	defer ticker.Stop()
+	pending := svc.Status{State: svc.StopPending, WaitHint: uint32(delay / time.Millisecond)}
+	st.status.report(pending)
+	for {
+		select {
+		case <-st.goroutinesDone():
+			return
+		case <-timer.C:
+			return
+		case <-st.deadline().Done():
+			return
+		case <-ticker.C:
+			pending.CheckPoint++
+			st.status.report(pending)
+		}
+	}
+}
+
+// join waits for the goroutines of the service until the deadline.
+func (st *stopSequence) join() {
+	st.joinOnce.Do(func() {
+		select {
+		case <-st.goroutinesDone():
+		case <-st.deadline().Done():
+			elog.Warning(1, fmt.Sprintf("The service '%s' still had running goroutines when the stop deadline of %s passed", st.sw.serviceName, st.sw.stopTimeout))
+		}
+	})
+}
+
+// finish releases the deadline.
+func (st *stopSequence) finish() {
+	if st.release != nil {
+		st.release()
+	}
+}
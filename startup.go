@@ -0,0 +1,71 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// startupWatcher reads the control requests while Execute is still starting
+// the service, so that a stop sent during a slow Schedule is not left
+// waiting until it returns. A stop runs the shutdown phases of the stop
+// sequence, as for a running service, then cancels the run context, which
+// Schedule is expected to honour.
+type startupWatcher struct {
+	stopped atomic.Bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func (sw *ServiceWrapper) watchStartup(r <-chan svc.ChangeRequest, status *statusReporter, stop *stopSequence, cancel context.CancelFunc) *startupWatcher {
+	w := &startupWatcher{done: make(chan struct{})}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		for {
+			select {
+			case <-w.done:
+				return
+			case c := <-r:
+				if sw.interceptor != nil && sw.interceptor(c) {
+					continue
+				}
+				switch c.Cmd {
+				case svc.Interrogate:
+					status.report(c.CurrentStatus)
+				case svc.Stop, svc.Shutdown, svc.PreShutdown:
+					elog.Info(1, fmt.Sprintf("The service '%s' is stopped while starting", sw.serviceName))
+					status.report(svc.Status{State: svc.StopPending})
+					w.stopped.Store(true)
+					// The service is stopped as it would be once running,
+					// shut down before its context is cancelled.
+					stop.shutdown()
+					cancel()
+					return
+				default:
+					elog.Warning(EventIDUnexpectedControl, fmt.Sprintf("control request #%d ignored while starting", c.Cmd))
+					status.report(c.CurrentStatus)
+				}
+			}
+		}
+	}()
+	return w
+}
+
+// end stops reading the control requests and reports whether a stop was
+// received. It must be called before anybody else reads them.
+func (w *startupWatcher) end() bool {
+	close(w.done)
+	w.wg.Wait()
+	return w.stopped.Load()
+}
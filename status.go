@@ -0,0 +1,107 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// statusReporter is the single owner of the changes channel handed to
+// Execute. All status updates go through it so concurrent writers are
+// serialized, and nothing is sent once the final status has been reported
+// and the SCM has stopped reading.
+type statusReporter struct {
+	mu       sync.Mutex
+	changes  chan<- svc.Status
+	observer func(svc.Status)
+	current  svc.Status
+	done     bool
+}
+
+func newStatusReporter(changes chan<- svc.Status, observer func(svc.Status)) *statusReporter {
+	return &statusReporter{changes: changes, observer: observer}
+}
+
+// send must be called with r.mu held. The observer runs before the send so
+// it sees the statuses in the order the SCM gets them.
+func (r *statusReporter) send(status svc.Status) {
+	r.current = status
+	if r.observer != nil {
+		r.observer(status)
+	}
+	r.changes <- status
+}
+
+// report sends status to the SCM and returns false if the final status has
+// already been reported.
+func (r *statusReporter) report(status svc.Status) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done {
+		return false
+	}
+	r.send(status)
+	return true
+}
+
+// reportIfRunning is report for updates that only apply while the service
+// is running, so they cannot overtake a stop.
+func (r *statusReporter) reportIfRunning(status svc.Status) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done || r.current.State != svc.Running {
+		return false
+	}
+	r.send(status)
+	return true
+}
+
+// finish sends the last status of the run; later reports are dropped. The
+// status carries no checkpoint, wait hint or accepted controls, so that the
+// SCM and monitoring tools don't see the stop as still in progress.
+func (r *statusReporter) finish(status svc.Status) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done {
+		return
+	}
+	status.CheckPoint, status.WaitHint, status.Accepts = 0, 0, 0
+	r.send(status)
+	r.done = true
+}
+
+// status returns the last status reported to the SCM.
+func (r *statusReporter) status() svc.Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// StateString returns the name of state, e.g. "Running".
+func StateString(state svc.State) string {
+	switch state {
+	case svc.Stopped:
+		return "Stopped"
+	case svc.StartPending:
+		return "StartPending"
+	case svc.StopPending:
+		return "StopPending"
+	case svc.Running:
+		return "Running"
+	case svc.ContinuePending:
+		return "ContinuePending"
+	case svc.PausePending:
+		return "PausePending"
+	case svc.Paused:
+		return "Paused"
+	}
+	return fmt.Sprintf("State(%d)", state)
+}
@@ -0,0 +1,100 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// WaitStrategy decides how ControlService and the management commands wait
+// for a service to reach its target state. Next is called with the last
+// queried status and the time waited so far, and returns how long to sleep
+// before querying again, or giveUp to fail the wait with a timeout. The
+// same strategy serves concurrent waits, so one keeping state must guard
+// it.
+type WaitStrategy interface {
+	Next(status svc.Status, elapsed time.Duration) (sleep time.Duration, giveUp bool)
+}
+
+type fixedWait struct {
+	interval, timeout time.Duration
+}
+
+// FixedWait queries every interval and gives up after timeout, or never
+// when timeout is zero.
+func FixedWait(interval, timeout time.Duration) WaitStrategy {
+	return fixedWait{interval: interval, timeout: timeout}
+}
+
+func (w fixedWait) Next(status svc.Status, elapsed time.Duration) (time.Duration, bool) {
+	return w.interval, w.timeout > 0 && elapsed >= w.timeout
+}
+
+type exponentialWait struct {
+	initial, max, timeout time.Duration
+}
+
+// ExponentialWait starts querying after initial and doubles the wait, up to
+// max, while the transition drags on; the waits are jittered so that
+// concurrent pollers spread out. It gives up after timeout, or never when
+// timeout is zero. This is how the wrapper waits by default, with the
+// intervals of WithControlPollInterval.
+func ExponentialWait(initial, max, timeout time.Duration) WaitStrategy {
+	return exponentialWait{initial: initial, max: max, timeout: timeout}
+}
+
+func (w exponentialWait) Next(status svc.Status, elapsed time.Duration) (time.Duration, bool) {
+	if w.timeout > 0 && elapsed >= w.timeout {
+		return 0, true
+	}
+	// After waiting initial, 2*initial, ..., elapsed plus initial is the
+	// next doubled interval.
+	sleep := elapsed + w.initial
+	if sleep > w.max {
+		sleep = w.max
+	}
+	return jitter(sleep), false
+}
+
+type waitHintWait struct {
+	interval, timeout time.Duration
+}
+
+// WaitHintWait queries every interval and gives up after timeout plus the
+// wait hint of the last status, so that a service announcing a slow start
+// or stop through its wait hint is given the time it asked for.
+func WaitHintWait(interval, timeout time.Duration) WaitStrategy {
+	return waitHintWait{interval: interval, timeout: timeout}
+}
+
+func (w waitHintWait) Next(status svc.Status, elapsed time.Duration) (time.Duration, bool) {
+	limit := w.timeout + time.Duration(status.WaitHint)*time.Millisecond
+	return w.interval, elapsed >= limit
+}
+
+// defaultControlTimeout bounds the controls when no WaitStrategy is set.
+const defaultControlTimeout = 10 * time.Second
+
+// controlContext bounds ctx by defaultControlTimeout, unless a WaitStrategy
+// decides when a wait gives up.
+func (sw *ServiceWrapper) controlContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if sw.waitStrategy != nil {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, defaultControlTimeout)
+}
+
+func (sw *ServiceWrapper) waitStrategyOrDefault() WaitStrategy {
+	if sw.waitStrategy != nil {
+		return sw.waitStrategy
+	}
+	return ExponentialWait(sw.pollInterval, sw.maxPollInterval, 0)
+}
@@ -0,0 +1,107 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package svchelper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+type waitDecision struct {
+	status     svc.Status
+	elapsed    time.Duration
+	wantSleep  time.Duration // exact, or the unjittered sleep for ExponentialWait
+	wantGiveUp bool
+}
+
+func checkDecisions(t *testing.T, name string, strategy WaitStrategy, jittered bool, decisions []waitDecision) {
+	t.Helper()
+	for _, d := range decisions {
+		sleep, giveUp := strategy.Next(d.status, d.elapsed)
+		if giveUp != d.wantGiveUp {
+			t.Errorf("%s.Next(%+v, %s) gave up = %t, want %t", name, d.status, d.elapsed, giveUp, d.wantGiveUp)
+			continue
+		}
+		if giveUp {
+			continue
+		}
+		if jittered {
+			if sleep < d.wantSleep-d.wantSleep/5 || sleep > d.wantSleep+d.wantSleep/5 {
+				t.Errorf("%s.Next(%+v, %s) = %s, want %s ± 20%%", name, d.status, d.elapsed, sleep, d.wantSleep)
+			}
+		} else if sleep != d.wantSleep {
+			t.Errorf("%s.Next(%+v, %s) = %s, want %s", name, d.status, d.elapsed, sleep, d.wantSleep)
+		}
+	}
+}
+
+var pending = svc.Status{State: svc.StartPending}
+
+func TestFixedWait(t *testing.T) {
+	checkDecisions(t, "FixedWait", FixedWait(250*time.Millisecond, 5*time.Second), false, []waitDecision{
+		{status: pending, elapsed: 0, wantSleep: 250 * time.Millisecond},
+		{status: pending, elapsed: 4 * time.Second, wantSleep: 250 * time.Millisecond},
+		{status: pending, elapsed: 5*time.Second - 1, wantSleep: 250 * time.Millisecond},
+		{status: pending, elapsed: 5 * time.Second, wantGiveUp: true},
+		{status: pending, elapsed: time.Minute, wantGiveUp: true},
+	})
+	checkDecisions(t, "FixedWait without timeout", FixedWait(time.Second, 0), false, []waitDecision{
+		{status: pending, elapsed: 0, wantSleep: time.Second},
+		{status: pending, elapsed: 24 * time.Hour, wantSleep: time.Second},
+	})
+}
+
+func TestExponentialWait(t *testing.T) {
+	checkDecisions(t, "ExponentialWait", ExponentialWait(100*time.Millisecond, time.Second, 10*time.Second), true, []waitDecision{
+		{status: pending, elapsed: 0, wantSleep: 100 * time.Millisecond},
+		{status: pending, elapsed: 100 * time.Millisecond, wantSleep: 200 * time.Millisecond},
+		{status: pending, elapsed: 300 * time.Millisecond, wantSleep: 400 * time.Millisecond},
+		{status: pending, elapsed: 700 * time.Millisecond, wantSleep: 800 * time.Millisecond},
+		{status: pending, elapsed: 1500 * time.Millisecond, wantSleep: time.Second},
+		{status: pending, elapsed: 9 * time.Second, wantSleep: time.Second},
+		{status: pending, elapsed: 10 * time.Second, wantGiveUp: true},
+	})
+	checkDecisions(t, "ExponentialWait without timeout", ExponentialWait(100*time.Millisecond, time.Second, 0), true, []waitDecision{
+		{status: pending, elapsed: time.Hour, wantSleep: time.Second},
+	})
+}
+
+func TestWaitHintWait(t *testing.T) {
+	hinted := svc.Status{State: svc.StopPending, WaitHint: 20000}
+	checkDecisions(t, "WaitHintWait", WaitHintWait(500*time.Millisecond, 10*time.Second), false, []waitDecision{
+		{status: pending, elapsed: 0, wantSleep: 500 * time.Millisecond},
+		{status: pending, elapsed: 10 * time.Second, wantGiveUp: true},
+		{status: hinted, elapsed: 10 * time.Second, wantSleep: 500 * time.Millisecond},
+		{status: hinted, elapsed: 30*time.Second - 1, wantSleep: 500 * time.Millisecond},
+		{status: hinted, elapsed: 30 * time.Second, wantGiveUp: true},
+	})
+}
+
+func TestControlContext(t *testing.T) {
+	sw := newTestWrapper(t, idle)
+	ctx, cancel := sw.controlContext(context.Background())
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > defaultControlTimeout {
+		t.Errorf("the control context has deadline %s (%t), want one within %s", deadline, ok, defaultControlTimeout)
+	}
+
+	// A WaitStrategy gives up on its own, leaving the context unbounded.
+	strategic := newTestWrapper(t, idle, WithWaitStrategy(FixedWait(time.Second, time.Minute)))
+	ctx, cancel = strategic.controlContext(context.Background())
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("the control context with a WaitStrategy has a deadline")
+	}
+	cancel()
+	if ctx.Err() == nil {
+		t.Error("cancelling the control context did not cancel it")
+	}
+}